@@ -0,0 +1,23 @@
+package eventtracker
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// AdminOnly wraps the admin handlers, the request must carry the admin token
+// in the Authorization header as "Bearer <token>" or in X-Admin-Token
+func AdminOnly(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := r.Header.Get("X-Admin-Token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			given = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "Unauthorized.", 401)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,265 @@
+package eventtracker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/lixin9311/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type api_key_config struct {
+	Key string `json:"key"`
+	// Id names the client in the records, the app by default
+	Id  string `json:"id"`
+	App string `json:"app"`
+	// Event_types the client may send, empty for all
+	Event_types []string `json:"event_types"`
+	// Endpoints the client may call, e.g. /event, empty for all
+	Endpoints []string `json:"endpoints"`
+}
+
+type auth_config struct {
+	Enabled bool
+	Keys    []api_key_config
+	// Key_file is a json array of keys in the same format as Keys
+	Key_file string
+	// Reload_interval is the interval to check the key file for changes
+	Reload_interval string
+}
+
+// Client is the authenticated sender of a request
+type Client struct {
+	Id  string `json:"id"`
+	App string `json:"app"`
+}
+
+type apiKey struct {
+	Client
+	eventTypes map[string]bool
+	endpoints  map[string]bool
+}
+
+type contextKey int
+
+const clientContextKey contextKey = 0
+
+// ClientFromRequest returns the authenticated client of the request, nil if
+// the request is not authenticated
+func ClientFromRequest(r *http.Request) *Client {
+	client, _ := r.Context().Value(clientContextKey).(*Client)
+	return client
+}
+
+// SetClient records the client in the client_id and client_app fields, the
+// fields are removed if client is nil
+func (self Event) SetClient(client *Client) {
+	if client == nil {
+		delete(self, "client_id")
+		delete(self, "client_app")
+		return
+	}
+	self["client_id"] = client.Id
+	self["client_app"] = client.App
+}
+
+// secretHeaders are the credentials removed from the logged headers
+var secretHeaders = []string{"X-Api-Key", "Authorization", "X-Admin-Token"}
+
+// RedactHeader returns a copy of the header for the logs, the credentials
+// are redacted
+func RedactHeader(header http.Header) http.Header {
+	redacted := http.Header{}
+	for k, v := range header {
+		redacted[k] = v
+	}
+	for _, k := range secretHeaders {
+		if _, ok := redacted[k]; ok {
+			redacted[k] = []string{"[redacted]"}
+		}
+	}
+	return redacted
+}
+
+// Authenticator checks the api key of the requests, in the X-Api-Key header
+// or the api_key query parameter. The keys of the config and the key file are
+// merged, the key file is reloaded when it changes.
+type Authenticator struct {
+	sync.RWMutex
+	static  []api_key_config
+	path    string
+	modTime time.Time
+	keys    map[string]*apiKey
+	clients map[string]*apiKey
+	logger  *logrus.Logger
+}
+
+// NewAuthenticator loads the keys and starts watching the key file
+func NewAuthenticator(w *logrus.Logger, conf auth_config) *Authenticator {
+	self := &Authenticator{static: conf.Keys, path: conf.Key_file, logger: w}
+	if _, err := self.load(true); err != nil {
+		w.WithFields(logrus.Fields{
+			"module": "auth",
+		}).Fatalln("Failed to load api keys:", err)
+	}
+	if self.path != "" {
+		interval := time.Minute
+		if conf.Reload_interval != "" {
+			var err error
+			if interval, err = time.ParseDuration(conf.Reload_interval); err != nil {
+				w.WithFields(logrus.Fields{
+					"module": "auth",
+				}).Fatalln("Invalid auth reload_interval:", err)
+			}
+		}
+		go func() {
+			for range time.Tick(interval) {
+				self.Reload(false)
+			}
+		}()
+	}
+	w.WithFields(logrus.Fields{
+		"module": "auth",
+	}).Infof("Init completed, %d api keys loaded.\n", len(self.keys))
+	return self
+}
+
+// Reload loads the key file again if it has changed or force is set
+func (self *Authenticator) Reload(force bool) {
+	reloaded, err := self.load(force)
+	if err != nil {
+		self.logger.WithFields(logrus.Fields{
+			"module": "auth",
+		}).Errorln("Failed to reload api keys:", err)
+	} else if reloaded {
+		self.RLock()
+		count := len(self.keys)
+		self.RUnlock()
+		self.logger.WithFields(logrus.Fields{
+			"module": "auth",
+		}).Infof("Api keys reloaded, %d keys.\n", count)
+	}
+}
+
+func (self *Authenticator) load(force bool) (bool, error) {
+	confs := append([]api_key_config{}, self.static...)
+	var modTime time.Time
+	if self.path != "" {
+		info, err := os.Stat(self.path)
+		if err != nil {
+			return false, err
+		}
+		if !force && info.ModTime().Equal(self.modTime) {
+			return false, nil
+		}
+		data, err := ioutil.ReadFile(self.path)
+		if err != nil {
+			return false, err
+		}
+		var file []api_key_config
+		if err = json.Unmarshal(data, &file); err != nil {
+			return false, err
+		}
+		confs = append(confs, file...)
+		modTime = info.ModTime()
+	} else if !force {
+		return false, nil
+	}
+	keys := map[string]*apiKey{}
+	clients := map[string]*apiKey{}
+	for _, conf := range confs {
+		key := &apiKey{Client: Client{Id: conf.Id, App: conf.App}, eventTypes: map[string]bool{}, endpoints: map[string]bool{}}
+		if key.Id == "" {
+			key.Id = conf.App
+		}
+		if conf.Key == "" || key.Id == "" {
+			return false, errors.New("Api key without key, id or app")
+		}
+		if _, ok := keys[conf.Key]; ok {
+			return false, errors.New("Duplicate api key of " + key.Id)
+		}
+		for _, event_type := range conf.Event_types {
+			key.eventTypes[event_type] = true
+		}
+		for _, endpoint := range conf.Endpoints {
+			key.endpoints[endpoint] = true
+		}
+		keys[conf.Key] = key
+		// a client may have several keys, e.g. during a rotation, they
+		// must have the same app and event types
+		if old, ok := clients[key.Id]; ok && (old.App != key.App || !sameSet(old.eventTypes, key.eventTypes)) {
+			return false, errors.New("Keys of client " + key.Id + " have different app or event types")
+		}
+		clients[key.Id] = key
+	}
+	self.Lock()
+	self.keys = keys
+	self.clients = clients
+	self.modTime = modTime
+	self.Unlock()
+	return true, nil
+}
+
+func sameSet(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if !b[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// Wrap authenticates the requests of an endpoint, the api_key query
+// parameter is removed so it is not recorded in the events
+func (self *Authenticator) Wrap(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		key := r.Header.Get("X-Api-Key")
+		if key == "" {
+			key = query.Get("api_key")
+		}
+		if _, ok := query["api_key"]; ok {
+			query.Del("api_key")
+			r.URL.RawQuery = query.Encode()
+			// the form may have been parsed by the signer
+			if r.Form != nil {
+				r.Form.Del("api_key")
+			}
+		}
+		self.RLock()
+		apiKey, ok := self.keys[key]
+		self.RUnlock()
+		if key == "" || !ok {
+			http.Error(w, "Invalid api key.", 401)
+			return
+		}
+		if len(apiKey.endpoints) != 0 && !apiKey.endpoints[endpoint] {
+			http.Error(w, "Endpoint not allowed for this api key.", 403)
+			return
+		}
+		client := apiKey.Client
+		handler(w, r.WithContext(context.WithValue(r.Context(), clientContextKey, &client)))
+	}
+}
+
+// Check checks that the client recorded in the event may send its event type
+func (self *Authenticator) Check(event Event) error {
+	id := event.String("client_id")
+	self.RLock()
+	key, ok := self.clients[id]
+	self.RUnlock()
+	if id == "" || !ok {
+		return &HandlerError{Code: 401, Msg: "Unknown client: " + id}
+	}
+	if len(key.eventTypes) != 0 && !key.eventTypes[event.EventType()] {
+		return &HandlerError{Code: 403, Msg: "Event type not allowed for client " + id + ": " + event.EventType()}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactHeader(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Api-Key", "secret")
+	header.Set("Authorization", "Bearer secret")
+	header.Set("Content-Type", "text/csv")
+	redacted := RedactHeader(header)
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"X-Api-Key", "[redacted]"},
+		{"Authorization", "[redacted]"},
+		{"X-Admin-Token", ""},
+		{"Content-Type", "text/csv"},
+	}
+	for _, test := range tests {
+		if got := redacted.Get(test.key); got != test.want {
+			t.Errorf("%s = %q, want %q", test.key, got, test.want)
+		}
+	}
+	if header.Get("X-Api-Key") != "secret" {
+		t.Error("the request header is modified")
+	}
+}
+
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	return NewAuthenticator(logrus.New(), auth_config{Keys: []api_key_config{
+		{Key: "key-a", Id: "partner_a", App: "game1", Event_types: []string{"order"}, Endpoints: []string{"/event"}},
+		{Key: "key-b", App: "game2"},
+	}})
+}
+
+func TestAuthenticatorWrap(t *testing.T) {
+	auth := newTestAuthenticator(t)
+	tests := []struct {
+		name   string
+		url    string
+		header string
+		code   int
+		client string
+	}{
+		{name: "key in the header", url: "/event?did=a", header: "key-a", code: 200, client: "partner_a"},
+		{name: "key in the query", url: "/event?did=a&api_key=key-a", code: 200, client: "partner_a"},
+		{name: "header wins over the query", url: "/event?did=a&api_key=wrong", header: "key-a", code: 200, client: "partner_a"},
+		{name: "id defaults to the app", url: "/event?did=a&api_key=key-b", code: 200, client: "game2"},
+		{name: "missing key", url: "/event?did=a", code: 401},
+		{name: "unknown key", url: "/event?did=a&api_key=wrong", code: 401},
+		{name: "endpoint not allowed", url: "/upload?did=a", header: "key-a", code: 403},
+	}
+	for _, test := range tests {
+		var client *Client
+		var query url.Values
+		handler := auth.Wrap(strings.SplitN(test.url, "?", 2)[0], func(w http.ResponseWriter, r *http.Request) {
+			client = ClientFromRequest(r)
+			query = r.URL.Query()
+			r.ParseForm()
+			if _, ok := r.Form["api_key"]; ok {
+				t.Errorf("%s: api_key in the form", test.name)
+			}
+		})
+		r := httptest.NewRequest("GET", test.url, nil)
+		if test.header != "" {
+			r.Header.Set("X-Api-Key", test.header)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: code = %d, want %d", test.name, w.Code, test.code)
+			continue
+		}
+		if test.code != 200 {
+			if client != nil {
+				t.Errorf("%s: handler called", test.name)
+			}
+			continue
+		}
+		if client == nil || client.Id != test.client {
+			t.Errorf("%s: client = %v, want %s", test.name, client, test.client)
+		}
+		if _, ok := query["api_key"]; ok || query.Get("did") != "a" {
+			t.Errorf("%s: query = %v", test.name, query)
+		}
+	}
+}
+
+func TestAuthenticatorCheck(t *testing.T) {
+	auth := newTestAuthenticator(t)
+	tests := []struct {
+		name  string
+		event Event
+		code  int
+	}{
+		{name: "allowed event type", event: Event{"client_id": "partner_a", "event_type": "order"}},
+		{name: "event type not allowed", event: Event{"client_id": "partner_a", "event_type": "open"}, code: 403},
+		{name: "all event types allowed", event: Event{"client_id": "game2", "event_type": "open"}},
+		{name: "unknown client", event: Event{"client_id": "partner_c", "event_type": "order"}, code: 401},
+		{name: "no client", event: Event{"event_type": "order"}, code: 401},
+	}
+	for _, test := range tests {
+		err := auth.Check(test.event)
+		if code := ErrorCode(err); (err == nil && test.code != 0) || (err != nil && code != test.code) {
+			t.Errorf("%s: err = %v, want code %d", test.name, err, test.code)
+		}
+	}
+}
+
+func TestAuthenticatorLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []api_key_config
+		fail bool
+	}{
+		{
+			name: "rotation overlap",
+			keys: []api_key_config{
+				{Key: "old", Id: "partner_a", App: "game1", Event_types: []string{"order"}},
+				{Key: "new", Id: "partner_a", App: "game1", Event_types: []string{"order"}},
+			},
+		},
+		{
+			name: "duplicate keys",
+			keys: []api_key_config{{Key: "same", Id: "partner_a"}, {Key: "same", Id: "partner_b"}},
+			fail: true,
+		},
+		{
+			name: "keys of a client with other event types",
+			keys: []api_key_config{
+				{Key: "old", Id: "partner_a", App: "game1", Event_types: []string{"order"}},
+				{Key: "new", Id: "partner_a", App: "game1", Event_types: []string{"order", "open"}},
+			},
+			fail: true,
+		},
+		{
+			name: "keys of a client with another app",
+			keys: []api_key_config{{Key: "old", Id: "partner_a", App: "game1"}, {Key: "new", Id: "partner_a", App: "game2"}},
+			fail: true,
+		},
+		{
+			name: "key without id or app",
+			keys: []api_key_config{{Key: "key"}},
+			fail: true,
+		},
+		{
+			name: "empty key",
+			keys: []api_key_config{{Id: "partner_a"}},
+			fail: true,
+		},
+	}
+	for _, test := range tests {
+		auth := &Authenticator{static: test.keys, logger: logrus.New()}
+		if _, err := auth.load(true); (err != nil) != test.fail {
+			t.Errorf("%s: err = %v", test.name, err)
+		}
+	}
+}
+
+// the old key keeps working until it is removed from the key file, the keys
+// of the file are merged with the config
+func TestAuthenticatorReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "api_keys.json")
+	write := func(data string, modTime time.Time) {
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(file, modTime, modTime)
+	}
+	var auth *Authenticator
+	valid := func(key string) bool {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/event", nil)
+		r.Header.Set("X-Api-Key", key)
+		auth.Wrap("/event", func(w http.ResponseWriter, r *http.Request) {})(w, r)
+		return w.Code == 200
+	}
+	now := time.Now()
+	write(`[{"key": "old", "id": "partner_a"}]`, now.Add(-time.Hour))
+	auth = NewAuthenticator(logrus.New(), auth_config{Keys: []api_key_config{{Key: "static", Id: "partner_b"}}, Key_file: file, Reload_interval: "1h"})
+	if !valid("old") || !valid("static") || valid("new") {
+		t.Fatal("unexpected keys after the load")
+	}
+	write(`[{"key": "old", "id": "partner_a"}, {"key": "new", "id": "partner_a"}]`, now.Add(-time.Minute))
+	auth.Reload(false)
+	if !valid("old") || !valid("new") || !valid("static") {
+		t.Error("both keys must be valid during the rotation")
+	}
+	write(`[{"key": "new", "id": "partner_a"}]`, now)
+	auth.Reload(false)
+	if valid("old") || !valid("new") {
+		t.Error("the old key is still valid")
+	}
+	// a broken file keeps the loaded keys
+	write(`[{"key": "new"}]`, now.Add(time.Minute))
+	auth.Reload(false)
+	if !valid("new") {
+		t.Error("the keys are lost by a broken file")
+	}
+}
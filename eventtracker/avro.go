@@ -1,6 +1,7 @@
 package eventtracker
 
 import (
+	"encoding/json"
 	"github.com/linkedin/goavro"
 	"github.com/lixin9311/logrus"
 	"io"
@@ -48,5 +49,45 @@ func (self *Avro) Encode(w io.Writer, data *goavro.Record) error {
 // Decode decodes a record
 func (self *Avro) Decode(r io.Reader) (*goavro.Record, error) {
 	record, err := self.codec.Decode(r)
-	return record.(*goavro.Record), err
+	if err != nil {
+		return nil, err
+	}
+	return record.(*goavro.Record), nil
+}
+
+// ExtensionArrays reports whether the values of the extension map accept
+// arrays of strings
+func (self *Avro) ExtensionArrays() bool {
+	var schema struct {
+		Fields []struct {
+			Name string
+			Type interface{}
+		}
+	}
+	if err := json.Unmarshal([]byte(self.recordSchemaJSON), &schema); err != nil {
+		return false
+	}
+	for _, field := range schema.Fields {
+		if field.Name != "extension" {
+			continue
+		}
+		for _, t := range unionTypes(field.Type) {
+			if m, ok := t.(map[string]interface{}); ok && m["type"] == "map" {
+				for _, v := range unionTypes(m["values"]) {
+					if a, ok := v.(map[string]interface{}); ok && a["type"] == "array" && a["items"] == "string" {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// unionTypes returns the member types of a union, or the type itself
+func unionTypes(t interface{}) []interface{} {
+	if union, ok := t.([]interface{}); ok {
+		return union
+	}
+	return []interface{}{t}
 }
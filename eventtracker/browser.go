@@ -0,0 +1,160 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transparentGIF is a 1x1 transparent gif
+var transparentGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+type cors_config struct {
+	// Allowed_origins are the origins allowed to call the json endpoints,
+	// "*" for any, empty to disable cors
+	Allowed_origins []string
+	// Allowed_headers are the request headers allowed in the preflight
+	Allowed_headers []string
+	// Allow_credentials allows the cookies, the origin is echoed instead of *.
+	// It can not be used with "*", which would allow every site to send
+	// credentialed requests.
+	Allow_credentials bool
+	// Max_age is the seconds the preflight result may be cached
+	Max_age int
+}
+
+// CORS handles the cross origin requests of the browsers
+type CORS struct {
+	origins     map[string]bool
+	any         bool
+	headers     string
+	credentials bool
+	maxAge      string
+}
+
+// NewCORS makes a cors handler
+func NewCORS(w *logrus.Logger, conf cors_config) *CORS {
+	self := &CORS{origins: map[string]bool{}, headers: "Content-Type, X-Api-Key", credentials: conf.Allow_credentials}
+	for _, origin := range conf.Allowed_origins {
+		if origin == "*" {
+			self.any = true
+		}
+		self.origins[strings.TrimSuffix(origin, "/")] = true
+	}
+	if self.any && self.credentials {
+		w.WithFields(logrus.Fields{
+			"module": "cors",
+		}).Fatalln("Allow_credentials can not be used with the \"*\" origin.")
+	}
+	if len(conf.Allowed_headers) != 0 {
+		self.headers = strings.Join(conf.Allowed_headers, ", ")
+	}
+	if conf.Max_age > 0 {
+		self.maxAge = strconv.Itoa(conf.Max_age)
+	}
+	w.WithFields(logrus.Fields{
+		"module": "cors",
+	}).Infoln("Allowed origins:", conf.Allowed_origins)
+	return self
+}
+
+// Wrap sets the cors headers of the allowed origins and answers the
+// preflight requests
+func (self *CORS) Wrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" {
+			handler(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !self.any && !self.origins[origin] {
+			if preflight {
+				http.Error(w, "Origin not allowed.", 403)
+				return
+			}
+			// the browser blocks the response without the cors headers
+			handler(w, r)
+			return
+		}
+		if self.any {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if self.credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", "X-Event-Id, X-Duplicate, X-Dropped, Retry-After")
+			handler(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", self.headers)
+		if self.maxAge != "" {
+			w.Header().Set("Access-Control-Max-Age", self.maxAge)
+		}
+		w.WriteHeader(204)
+	}
+}
+
+// PixelHandler records the query parameters as an event and responds with a
+// transparent gif, which is returned even if the event is rejected. The
+// timestamp is the time of the request if not provided.
+func (self *DefaultHandler) PixelHandler(w http.ResponseWriter, r *http.Request) {
+	event := self.formEvent(r.URL.Query())
+	setDefault(event, "timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	self.setRequestFields(event, r)
+	if _, _, err := self.SendEvent(event, self.eventSource(r)); err != nil && err != ErrDuplicate && err != ErrDropped {
+		self.logger.WithFields(logrus.Fields{
+			"module": "Handler",
+		}).Warnln("Failed to write pixel event:", err)
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Content-Length", strconv.Itoa(len(transparentGIF)))
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate, private")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("X-Event-Id", event.String("event_id"))
+	w.Write(transparentGIF)
+}
+
+// BeaconHandler accepts the json body sent by navigator.sendBeacon, which is
+// text/plain to avoid the cors preflight. The body is one event object or an
+// array of events, 204 is returned if every event has been accepted,
+// otherwise the error of the first rejected one.
+func (self *DefaultHandler) BeaconHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		self.ErrorAndReturnCode(w, "Method not allowed.", 405)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, self.MaxFileSize)
+	events, err := DecodeJSONEvents(r.Body)
+	if err != nil {
+		self.ErrorAndReturnCode(w, "Failed to parse json body:"+err.Error(), 400)
+		return
+	}
+	var first error
+	source := self.eventSource(r)
+	for _, event := range self.jsonEvents(events) {
+		self.setRequestFields(event, r)
+		if _, _, err = self.SendEvent(event, source); err == nil {
+			MarkWritten(r)
+		} else if err != ErrDuplicate && err != ErrDropped && first == nil {
+			first = err
+		}
+	}
+	if first != nil {
+		self.writeError(w, first)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,52 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}
+	listed := NewCORS(logrus.New(), cors_config{Allowed_origins: []string{"https://www.example.com/"}, Allow_credentials: true}).Wrap(ok)
+	any := NewCORS(logrus.New(), cors_config{Allowed_origins: []string{"*"}}).Wrap(ok)
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		method      string
+		origin      string
+		code        int
+		allow       string
+		credentials string
+	}{
+		{name: "same origin", handler: listed, method: "POST", code: 200},
+		{name: "allowed origin", handler: listed, method: "POST", origin: "https://www.example.com", code: 200, allow: "https://www.example.com", credentials: "true"},
+		{name: "allowed preflight", handler: listed, method: "OPTIONS", origin: "https://www.example.com", code: 204, allow: "https://www.example.com", credentials: "true"},
+		{name: "other origin", handler: listed, method: "POST", origin: "https://evil.example.com", code: 200},
+		{name: "other origin preflight", handler: listed, method: "OPTIONS", origin: "https://evil.example.com", code: 403},
+		{name: "any origin", handler: any, method: "POST", origin: "https://evil.example.com", code: 200, allow: "*"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/event", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.method == "OPTIONS" {
+			r.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		w := httptest.NewRecorder()
+		test.handler(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: code = %d, want %d", test.name, w.Code, test.code)
+		}
+		if allow := w.Header().Get("Access-Control-Allow-Origin"); allow != test.allow {
+			t.Errorf("%s: allowed origin = %q, want %q", test.name, allow, test.allow)
+		}
+		if credentials := w.Header().Get("Access-Control-Allow-Credentials"); credentials != test.credentials {
+			t.Errorf("%s: credentials = %q, want %q", test.name, credentials, test.credentials)
+		}
+	}
+}
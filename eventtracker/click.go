@@ -0,0 +1,172 @@
+package eventtracker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/lixin9311/logrus"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type click_config struct {
+	Enabled bool
+	// Event_type of the click events, which decides the kafka topic, click
+	// by default
+	Event_type string
+	// Allowed_hosts are the destination hosts redirected without a
+	// signature, "*.example.com" matches the subdomains
+	Allowed_hosts []string
+	// Sign_key signs the other destinations, the sig parameter is the hex
+	// hmac-sha256 of the url parameter, empty to only allow the hosts
+	Sign_key string
+	// Click_id_param is the query parameter of the click id appended to the
+	// destination, click_id by default
+	Click_id_param string
+}
+
+// ClickRedirector checks the destinations of the click endpoint against the
+// allowed hosts or the signature, so it can not be used as an open redirect
+type ClickRedirector struct {
+	eventType string
+	hosts     map[string]bool
+	suffixes  []string
+	key       []byte
+	param     string
+}
+
+// NewClickRedirector makes a click redirector
+func NewClickRedirector(w *logrus.Logger, conf click_config) *ClickRedirector {
+	self := &ClickRedirector{eventType: conf.Event_type, hosts: map[string]bool{}, key: []byte(conf.Sign_key), param: conf.Click_id_param}
+	if self.eventType == "" {
+		self.eventType = "click"
+	}
+	if self.param == "" {
+		self.param = "click_id"
+	}
+	for _, host := range conf.Allowed_hosts {
+		host = strings.ToLower(host)
+		if strings.HasPrefix(host, "*.") {
+			self.suffixes = append(self.suffixes, host[1:])
+		} else {
+			self.hosts[host] = true
+		}
+	}
+	if len(conf.Allowed_hosts) == 0 && conf.Sign_key == "" {
+		w.WithFields(logrus.Fields{
+			"module": "click",
+		}).Fatalln("Neither allowed_hosts nor sign_key is set, every click would be rejected.")
+	}
+	w.WithFields(logrus.Fields{
+		"module": "click",
+	}).Infoln("Allowed hosts:", conf.Allowed_hosts)
+	return self
+}
+
+// Sign returns the signature of a destination url
+func (self *ClickRedirector) Sign(destination string) string {
+	mac := hmac.New(sha256.New, self.key)
+	mac.Write([]byte(destination))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (self *ClickRedirector) allowedHost(host string) bool {
+	host = strings.ToLower(host)
+	if self.hosts[host] {
+		return true
+	}
+	for _, suffix := range self.suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Destination parses the destination url, which must be an absolute http or
+// https url of an allowed host, or signed by sig
+func (self *ClickRedirector) Destination(destination, sig string) (*url.URL, error) {
+	if destination == "" {
+		return nil, errors.New("Missing destination url.")
+	}
+	u, err := url.Parse(destination)
+	if err != nil {
+		return nil, errors.New("Invalid destination url: " + err.Error())
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.User != nil {
+		return nil, errors.New("Invalid destination url: " + destination)
+	}
+	if self.allowedHost(u.Hostname()) {
+		return u, nil
+	}
+	if len(self.key) != 0 && sig != "" && hmac.Equal([]byte(strings.ToLower(sig)), []byte(self.Sign(destination))) {
+		return u, nil
+	}
+	return nil, errors.New("Destination not allowed: " + destination)
+}
+
+// AppendClickId appends the click id to the query of the destination, the
+// other parameters are kept as they are since the advertisers may not
+// decode them
+func (self *ClickRedirector) AppendClickId(u *url.URL, id string) string {
+	param := url.QueryEscape(self.param) + "=" + url.QueryEscape(id)
+	if u.RawQuery == "" {
+		u.RawQuery = param
+	} else {
+		u.RawQuery += "&" + param
+	}
+	return u.String()
+}
+
+// ClickHandler records the query parameters, e.g. did, aid and campaign, as a
+// click event with a generated click id, and redirects to the destination in
+// the url parameter with the click id appended. The redirect is issued even
+// if the event is not written, without the click id, so the postbacks do not
+// refer to missing clicks.
+func (self *DefaultHandler) ClickHandler(w http.ResponseWriter, r *http.Request) {
+	if self.Clicks == nil {
+		self.ErrorAndReturnCode(w, "Click endpoint not enabled.", 404)
+		return
+	}
+	query := r.URL.Query()
+	destination, err := self.Clicks.Destination(query.Get("url"), query.Get("sig"))
+	if err != nil {
+		self.ErrorAndReturnCode(w, err.Error(), 400)
+		return
+	}
+	query.Del("url")
+	query.Del("sig")
+	event := self.formEvent(query)
+	event["event_type"] = self.Clicks.eventType
+	setDefault(event, "timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	// the click id is the event id, so the postbacks can be matched
+	delete(event, "event_id")
+	event.Id()
+	self.setRequestFields(event, r)
+	// the user agent is always recorded for the clicks
+	event.SetUserAgent(r.UserAgent())
+	// the clicks have no api key, they are not checked against the clients
+	source := self.eventSource(r)
+	source.Public = true
+	_, _, err = self.SendEvent(event, source)
+	if err != nil && err != ErrDuplicate && err != ErrDropped {
+		self.logger.WithFields(logrus.Fields{
+			"module": "Handler",
+		}).Warnln("Failed to write click event:", err)
+	}
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate, private")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+	if err != nil && err != ErrDuplicate {
+		http.Redirect(w, r, destination.String(), 302)
+		return
+	}
+	// a duplicated click gets the id of the first one
+	id := event.String("event_id")
+	w.Header().Set("X-Event-Id", id)
+	http.Redirect(w, r, self.Clicks.AppendClickId(destination, id), 302)
+}
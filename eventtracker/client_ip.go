@@ -0,0 +1,114 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type proxy_config struct {
+	// Trusted lists the ips or cidrs of the proxies in front of the
+	// tracker, e.g. the front server
+	Trusted []string
+}
+
+// IPResolver resolves the client ip of a request behind trusted proxies
+type IPResolver struct {
+	trusted []*net.IPNet
+}
+
+// NewIPResolver makes an ip resolver
+func NewIPResolver(w *logrus.Logger, conf proxy_config) *IPResolver {
+	self := &IPResolver{}
+	for _, v := range conf.Trusted {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, cidr, err := net.ParseCIDR(v)
+		if err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "proxy",
+			}).Fatalln("Invalid trusted proxy:", err)
+		}
+		self.trusted = append(self.trusted, cidr)
+	}
+	return self
+}
+
+// Trusted reports whether the ip is a trusted proxy
+func (self *IPResolver) Trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, cidr := range self.trusted {
+		if cidr.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the ip of the client. X-Forwarded-For and X-Real-IP are
+// only honored when the request comes from a trusted proxy, the forwarded
+// addresses are walked from the nearest one until an untrusted ip is found.
+func (self *IPResolver) ClientIP(r *http.Request) string {
+	remote := RemoteIP(r)
+	if !self.Trusted(remote) {
+		return remote
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+		client := remote
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			client = hop
+			if !self.Trusted(hop) {
+				break
+			}
+		}
+		return client
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
+	}
+	return remote
+}
+
+// RemoteIP returns the ip of the peer of the connection
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// SetClientIP records the server observed ip in the observed_ip field, and
+// fills the ip field if the client did not declare one. The source of the ip
+// field, client or observed, is recorded in ip_source. The observed_ip and
+// ip_source declared by the client are dropped, an empty ip only does this,
+// e.g. for the uploaded files.
+func (self Event) SetClientIP(ip string) {
+	delete(self, "observed_ip")
+	delete(self, "ip_source")
+	if self.String("ip") != "" {
+		self["ip_source"] = "client"
+	}
+	if ip == "" {
+		return
+	}
+	self["observed_ip"] = ip
+	if self.String("ip") == "" {
+		self["ip"] = ip
+		self["ip_source"] = "observed"
+	}
+}
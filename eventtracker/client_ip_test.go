@@ -0,0 +1,67 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	resolver := NewIPResolver(logrus.New(), proxy_config{Trusted: []string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32", "::1"}})
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		real      string
+		want      string
+	}{
+		{name: "direct client", remote: "81.2.69.160:1234", want: "81.2.69.160"},
+		{name: "untrusted peer is not honored", remote: "81.2.69.160:1234", forwarded: []string{"1.2.3.4"}, real: "1.2.3.4", want: "81.2.69.160"},
+		{name: "trusted proxy", remote: "10.0.0.1:1234", forwarded: []string{"81.2.69.160"}, want: "81.2.69.160"},
+		{name: "spoofed first hop", remote: "10.0.0.1:1234", forwarded: []string{"1.2.3.4, 81.2.69.160"}, want: "81.2.69.160"},
+		{name: "chain of trusted proxies", remote: "10.0.0.1:1234", forwarded: []string{"1.2.3.4, 81.2.69.160, 192.168.1.1, 10.0.0.2"}, want: "81.2.69.160"},
+		{name: "multiple headers", remote: "10.0.0.1:1234", forwarded: []string{"1.2.3.4", "81.2.69.160"}, want: "81.2.69.160"},
+		{name: "all hops trusted", remote: "10.0.0.1:1234", forwarded: []string{"10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{name: "malformed hop", remote: "10.0.0.1:1234", forwarded: []string{"81.2.69.160, unknown"}, want: "10.0.0.1"},
+		{name: "malformed hop after a client", remote: "10.0.0.1:1234", forwarded: []string{"garbage, 81.2.69.160"}, want: "81.2.69.160"},
+		{name: "hop with a port", remote: "10.0.0.1:1234", forwarded: []string{"81.2.69.160:80"}, want: "10.0.0.1"},
+		{name: "ipv6 proxy", remote: "[2001:db8::1]:1234", forwarded: []string{"2a02:1234::5"}, want: "2a02:1234::5"},
+		{name: "ipv6 loopback proxy", remote: "[::1]:1234", forwarded: []string{"81.2.69.160"}, want: "81.2.69.160"},
+		{name: "untrusted ipv6 peer", remote: "[2a02:1234::5]:1234", forwarded: []string{"81.2.69.160"}, want: "2a02:1234::5"},
+		{name: "x-real-ip", remote: "10.0.0.1:1234", real: "81.2.69.160", want: "81.2.69.160"},
+		{name: "malformed x-real-ip", remote: "10.0.0.1:1234", real: "unknown", want: "10.0.0.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/event", nil)
+		r.RemoteAddr = test.remote
+		for _, v := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if test.real != "" {
+			r.Header.Set("X-Real-IP", test.real)
+		}
+		if ip := resolver.ClientIP(r); ip != test.want {
+			t.Errorf("%s: ip = %s, want %s", test.name, ip, test.want)
+		}
+	}
+}
+
+func TestSetClientIP(t *testing.T) {
+	tests := []struct {
+		name  string
+		event Event
+		ip    string
+		want  Event
+	}{
+		{name: "observed ip", event: Event{}, ip: "81.2.69.160", want: Event{"ip": "81.2.69.160", "observed_ip": "81.2.69.160", "ip_source": "observed"}},
+		{name: "client ip", event: Event{"ip": "1.2.3.4"}, ip: "81.2.69.160", want: Event{"ip": "1.2.3.4", "observed_ip": "81.2.69.160", "ip_source": "client"}},
+		{name: "declared observed ip is dropped", event: Event{"observed_ip": "1.2.3.4", "ip_source": "observed"}, want: Event{}},
+	}
+	for _, test := range tests {
+		test.event.SetClientIP(test.ip)
+		if !reflect.DeepEqual(test.event, test.want) {
+			t.Errorf("%s: event = %v, want %v", test.name, test.event, test.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package eventtracker
+
+import (
+	"errors"
+	"github.com/lixin9311/logrus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// column_profile maps the csv title of a partner to the event fields
+type column_profile struct {
+	// Columns maps the partner title to the event field, the columns mapped
+	// to an empty field are ignored
+	Columns map[string]string
+	// Transforms are applied to the value of an event field in order,
+	// available: trim, lowercase, uppercase
+	Transforms map[string][]string
+	// Timestamp_format is the go time layout of the timestamp column,
+	// the timestamp is converted to unix seconds
+	Timestamp_format string
+}
+
+type valueTransform func(string) (string, error)
+
+// ColumnMapper renames the csv columns and transforms their values
+type ColumnMapper struct {
+	columns    map[string]string
+	transforms map[string][]valueTransform
+}
+
+// NewColumnMapper makes a column mapper from a profile
+func NewColumnMapper(conf column_profile) (*ColumnMapper, error) {
+	self := &ColumnMapper{columns: map[string]string{}, transforms: map[string][]valueTransform{}}
+	for k, v := range conf.Columns {
+		self.columns[k] = v
+	}
+	for field, names := range conf.Transforms {
+		for _, name := range names {
+			switch name {
+			case "trim":
+				self.transforms[field] = append(self.transforms[field], func(v string) (string, error) {
+					return strings.TrimSpace(v), nil
+				})
+			case "lowercase":
+				self.transforms[field] = append(self.transforms[field], func(v string) (string, error) {
+					return strings.ToLower(v), nil
+				})
+			case "uppercase":
+				self.transforms[field] = append(self.transforms[field], func(v string) (string, error) {
+					return strings.ToUpper(v), nil
+				})
+			default:
+				return nil, errors.New("Unknown transform: " + name)
+			}
+		}
+	}
+	if conf.Timestamp_format != "" {
+		layout := conf.Timestamp_format
+		self.transforms["timestamp"] = append(self.transforms["timestamp"], func(v string) (string, error) {
+			t, err := time.ParseInLocation(layout, v, time.UTC)
+			if err != nil {
+				return "", err
+			}
+			return strconv.FormatInt(t.Unix(), 10), nil
+		})
+	}
+	return self, nil
+}
+
+// Field returns the event field of a csv title, empty if the column is
+// ignored
+func (self *ColumnMapper) Field(title string) string {
+	if field, ok := self.columns[title]; ok {
+		return field
+	}
+	return title
+}
+
+// Value transforms the value of an event field
+func (self *ColumnMapper) Value(field, value string) (string, error) {
+	var err error
+	for _, transform := range self.transforms[field] {
+		if value, err = transform(value); err != nil {
+			return "", errors.New("Failed to transform " + field + ":" + err.Error())
+		}
+	}
+	return value, nil
+}
+
+// NewColumnProfiles makes the column mappers of the upload config, the
+// default profile has an empty name
+func NewColumnProfiles(w *logrus.Logger, conf upload_config) map[string]*ColumnMapper {
+	profiles := map[string]*ColumnMapper{}
+	defaults := column_profile{Columns: conf.Columns, Transforms: conf.Transforms, Timestamp_format: conf.Timestamp_format}
+	mapper, err := NewColumnMapper(defaults)
+	if err != nil {
+		w.WithFields(logrus.Fields{
+			"module": "upload",
+		}).Fatalln("Invalid upload columns:", err)
+	}
+	profiles[""] = mapper
+	for name, profile := range conf.Profiles {
+		mapper, err := NewColumnMapper(profile)
+		if err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "upload",
+			}).Fatalln("Invalid upload profile", name, ":", err)
+		}
+		profiles[name] = mapper
+	}
+	return profiles
+}
@@ -0,0 +1,108 @@
+package eventtracker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestColumnMapper(t *testing.T) {
+	mapper, err := NewColumnMapper(column_profile{
+		Columns:          map[string]string{"IDFA": "did", "time": "timestamp", "memo": ""},
+		Transforms:       map[string][]string{"did": {"trim", "lowercase"}},
+		Timestamp_format: "2006-01-02 15:04:05",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]string{"IDFA": "did", "time": "timestamp", "memo": "", "channel": "channel"}
+	for title, want := range fields {
+		if field := mapper.Field(title); field != want {
+			t.Errorf("Field(%q) = %q, want %q", title, field, want)
+		}
+	}
+	values := []struct {
+		field string
+		value string
+		want  string
+		fail  bool
+	}{
+		{field: "did", value: " ABC ", want: "abc"},
+		{field: "channel", value: " Ads ", want: " Ads "},
+		{field: "timestamp", value: "2016-02-20 20:26:40", want: "1456000000"},
+		{field: "timestamp", value: "1456000000", fail: true},
+	}
+	for _, test := range values {
+		value, err := mapper.Value(test.field, test.value)
+		if (err != nil) != test.fail || value != test.want {
+			t.Errorf("Value(%q, %q) = %q, %v", test.field, test.value, value, err)
+		}
+	}
+	if _, err := NewColumnMapper(column_profile{Transforms: map[string][]string{"did": {"reverse"}}}); err == nil {
+		t.Error("unknown transform is accepted")
+	}
+}
+
+func TestImportCSVColumns(t *testing.T) {
+	tests := []struct {
+		name string
+		csv  string
+		want map[string]interface{}
+		fail bool
+	}{
+		{
+			name: "renamed and ignored columns",
+			csv:  "IDFA,time,action,memo\n ABC ,1456000000,open,call back\n",
+			want: map[string]interface{}{"did": "abc", "timestamp": "1456000000", "event_type": "open"},
+		},
+		{
+			name: "missing column",
+			csv:  "IDFA,action\nabc,open\n",
+			fail: true,
+		},
+		{
+			name: "required column is ignored",
+			csv:  "IDFA,time,memo\nabc,1456000000,open\n",
+			fail: true,
+		},
+	}
+	for _, test := range tests {
+		handler, _ := newTestHandler(t)
+		mapper, err := NewColumnMapper(column_profile{
+			Columns:    map[string]string{"IDFA": "did", "time": "timestamp", "action": "event_type", "memo": ""},
+			Transforms: map[string][]string{"did": {"trim", "lowercase"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.Profiles = map[string]*ColumnMapper{"partner": mapper}
+		report, err := handler.ImportCSV(strings.NewReader(test.csv), ImportOptions{DryRun: true, Profile: "partner"})
+		if (err != nil) != test.fail {
+			t.Errorf("%s: err = %v", test.name, err)
+			continue
+		}
+		if test.fail {
+			continue
+		}
+		if len(report.Records) != 1 {
+			t.Errorf("%s: report = %+v", test.name, report)
+			continue
+		}
+		// the fields which are not top level are in the extension
+		record := map[string]interface{}{}
+		extension, _ := report.Records[0]["extension"].(map[string]interface{})
+		for k, v := range extension {
+			record[k] = v
+		}
+		for k, v := range report.Records[0] {
+			record[k] = v
+		}
+		for k, v := range test.want {
+			if record[k] != v {
+				t.Errorf("%s: %s = %#v, want %#v", test.name, k, record[k], v)
+			}
+		}
+		if _, ok := record["memo"]; ok {
+			t.Errorf("%s: ignored column in record: %v", test.name, record)
+		}
+	}
+}
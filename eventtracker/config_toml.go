@@ -12,6 +12,8 @@ type main_config struct {
 	Log_file_formatter string
 	Log_level          string
 	Backup_file        string
+	// Admin_token protects the admin api, empty to disable it
+	Admin_token string
 }
 
 type kafka_config struct {
@@ -26,6 +28,33 @@ type avro_config struct {
 	Schema string
 }
 
+type stream_config struct {
+	Max_lines         int
+	Max_line_size     int
+	Progress_interval int
+}
+
+type upload_config struct {
+	Job_dir string
+	Workers int
+	// Max_job_file_size is the maximum size of an asynchronous upload in
+	// bytes, 1GB by default
+	Max_job_file_size int64
+	// Checkpoint_lines is the number of lines between two saves of the job
+	// state, 1000 by default. The lines after the last save are sent again
+	// when the job is resumed.
+	Checkpoint_lines int
+	// Job_ttl is how long the finished jobs are kept, in go duration format,
+	// 168h by default
+	Job_ttl string
+	// the default column profile
+	Columns          map[string]string
+	Transforms       map[string][]string
+	Timestamp_format string
+	// column profiles selected by the profile field of the upload form
+	Profiles map[string]column_profile
+}
+
 type front_config struct {
 	Enabled                  bool
 	Service_reg_addr         string
@@ -47,11 +76,30 @@ type extension_config struct {
 }
 
 type Config struct {
-	Main      main_config
-	Kafka     kafka_config
-	Avro      avro_config
-	Front     front_config
-	Extension extension_config
+	Main        main_config
+	Kafka       kafka_config
+	Avro        avro_config
+	Events      map[string]event_rule_config
+	Multi_value multi_value_config
+	Proxy       proxy_config
+	Geoip       geoip_config
+	Useragent   useragent_config
+	Lookup      []lookup_config
+	Script      []script_config
+	Pii         pii_config
+	Consent     consent_config
+	Auth        auth_config
+	Signing     map[string]signing_config
+	Ratelimit   ratelimit_config
+	Cors        cors_config
+	Click       click_config
+	Timestamp   timestamp_config
+	Device_id   device_id_config
+	Dedup       dedup_config
+	Stream      stream_config
+	Upload      upload_config
+	Front       front_config
+	Extension   extension_config
 }
 
 func ParseConfig(path string) *Config {
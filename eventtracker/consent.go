@@ -0,0 +1,293 @@
+package eventtracker
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/lixin9311/logrus"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// ConsentDrop drops the events without consent
+	ConsentDrop = "drop"
+	// ConsentStrip removes the identifiers of the events without consent
+	ConsentStrip = "strip"
+	// ConsentRoute sends the events without consent to the restricted topic
+	ConsentRoute = "route"
+)
+
+type consent_config struct {
+	Enabled bool
+	// Policy is drop, strip or route
+	Policy string
+	// Restricted_topic is the kafka topic of the route policy
+	Restricted_topic string
+	// Strip_fields are the identifiers removed by the strip policy
+	Strip_fields []string
+	// Opt_out_file keeps the opted out dids, one per line
+	Opt_out_file string
+}
+
+// defaultStripFields are the identifiers removed by the strip policy if not
+// configured
+var defaultStripFields = []string{"did", "aid", "ip", "observed_ip", "idfa", "idfv", "gaid", "android_id", "imei", "mac", "user_id", "user_agent"}
+
+// ConsentChecker applies the opt-out policy to the events of the devices in
+// the opt-out list, and to the events without consent: lat (limit ad
+// tracking) is 1 or true, or gdpr is 1 and gdpr_consent is empty
+type ConsentChecker struct {
+	sync.RWMutex
+	policy string
+	topic  string
+	strip  []string
+	file   string
+	optOut map[string]bool
+	logger *logrus.Logger
+}
+
+// NewConsentChecker makes a consent checker, the opt-out list is loaded from
+// the file
+func NewConsentChecker(w *logrus.Logger, conf consent_config) *ConsentChecker {
+	self := &ConsentChecker{policy: conf.Policy, topic: conf.Restricted_topic, strip: conf.Strip_fields, file: conf.Opt_out_file, optOut: map[string]bool{}, logger: w}
+	switch conf.Policy {
+	case "":
+		self.policy = ConsentDrop
+	case ConsentDrop, ConsentStrip:
+	case ConsentRoute:
+		if conf.Restricted_topic == "" {
+			w.WithFields(logrus.Fields{
+				"module": "consent",
+			}).Fatalln("Restricted topic is required by the route policy.")
+		}
+	default:
+		w.WithFields(logrus.Fields{
+			"module": "consent",
+		}).Fatalln("Unrecognized consent policy:", conf.Policy)
+	}
+	if len(self.strip) == 0 {
+		self.strip = defaultStripFields
+	}
+	if self.file != "" {
+		if err := self.load(); err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "consent",
+			}).Fatalln("Failed to load opt-out file:", err)
+		}
+	}
+	w.WithFields(logrus.Fields{
+		"module": "consent",
+	}).Infof("Init completed, %d opted out devices.\n", len(self.optOut))
+	return self
+}
+
+// optOutKey returns the key of a did in the opt-out list, dids are compared
+// in the normalized format and case insensitively
+func optOutKey(did string) string {
+	if normalized, _, ok := NormalizeDeviceId(did, "", ""); ok {
+		did = normalized
+	}
+	return strings.ToLower(strings.TrimSpace(did))
+}
+
+// OptedOut tells whether the did is in the opt-out list
+func (self *ConsentChecker) OptedOut(did string) bool {
+	self.RLock()
+	defer self.RUnlock()
+	return self.optOut[optOutKey(did)]
+}
+
+// Count returns the size of the opt-out list
+func (self *ConsentChecker) Count() int {
+	self.RLock()
+	defer self.RUnlock()
+	return len(self.optOut)
+}
+
+// Update adds or removes the dids of the opt-out list and saves it, the
+// number of changed dids is returned
+func (self *ConsentChecker) Update(dids []string, optOut bool) (int, error) {
+	self.Lock()
+	defer self.Unlock()
+	changed := 0
+	for _, did := range dids {
+		key := optOutKey(did)
+		if key == "" || self.optOut[key] == optOut {
+			continue
+		}
+		if optOut {
+			self.optOut[key] = true
+		} else {
+			delete(self.optOut, key)
+		}
+		changed++
+	}
+	if changed == 0 || self.file == "" {
+		return changed, nil
+	}
+	return changed, self.save()
+}
+
+// save writes the opt-out list to the file, the caller must hold the lock
+func (self *ConsentChecker) save() error {
+	dids := make([]string, 0, len(self.optOut))
+	for did := range self.optOut {
+		dids = append(dids, did)
+	}
+	sort.Strings(dids)
+	tmp := self.file + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, did := range dids {
+		writer.WriteString(did + "\n")
+	}
+	if err = writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, self.file)
+}
+
+func (self *ConsentChecker) load() error {
+	file, err := os.Open(self.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if key := optOutKey(scanner.Text()); key != "" {
+			self.optOut[key] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// Reason returns why the event has no consent, empty if it has
+func (self *ConsentChecker) Reason(event Event) string {
+	switch strings.ToLower(event.String("lat")) {
+	case "1", "true":
+		return "lat"
+	}
+	if event.String("gdpr") == "1" && event.String("gdpr_consent") == "" {
+		return "gdpr"
+	}
+	if event.String("did") != "" && self.OptedOut(event.String("did")) {
+		return "opt_out"
+	}
+	return ""
+}
+
+// Apply applies the policy to the event if it has no consent, the reason is
+// recorded in the opt_out field. It runs before the device id checks, which
+// only flag the zeroed and unknown ids of the events without consent, and
+// before the enrichment, whose fields are removed by StripEnrichment. A zeroed
+// id without the lat or gdpr fields is not a reason by itself, it is left to
+// the device id policy.
+func (self *ConsentChecker) Apply(event Event) error {
+	reason := self.Reason(event)
+	if reason == "" {
+		return nil
+	}
+	switch self.policy {
+	case ConsentDrop:
+		return ErrDropped
+	case ConsentStrip:
+		for _, field := range self.strip {
+			if IsTopLevelField(field) {
+				if _, ok := event[field]; ok {
+					event[field] = ""
+				}
+			} else {
+				delete(event, field)
+			}
+		}
+	case ConsentRoute:
+		event[TopicField] = self.topic
+	}
+	event["opt_out"] = reason
+	return nil
+}
+
+// Enforce sets the opt_out reason recorded by Apply again after the
+// enrichment, and the restricted topic of the route policy, so the scripts
+// can neither clear the reason nor send the event to another topic
+func (self *ConsentChecker) Enforce(event Event, reason string) {
+	if reason == "" {
+		return
+	}
+	event["opt_out"] = reason
+	if self.policy == ConsentRoute {
+		event[TopicField] = self.topic
+	}
+}
+
+// Stripped tells whether the identifiers of the event have been stripped
+func (self *ConsentChecker) Stripped(event Event) bool {
+	return self.policy == ConsentStrip && event.String("opt_out") != ""
+}
+
+// StripEnrichment removes the fields added to a stripped event after its
+// fields were recorded, e.g. the geo, user agent and lookup fields. The
+// topic chosen by a script is kept.
+func (self *ConsentChecker) StripEnrichment(event Event, fields map[string]bool) {
+	for k := range event {
+		if !fields[k] && k != TopicField {
+			delete(event, k)
+		}
+	}
+}
+
+// OptOutHandler manages the opt-out list. GET checks the did parameter, or
+// returns the size of the list. POST adds and DELETE removes the dids in the
+// did parameters, or in the body one per line.
+func (self *DefaultHandler) OptOutHandler(w http.ResponseWriter, r *http.Request) {
+	if self.Consent == nil {
+		self.ErrorAndReturnCode(w, "Consent is not enabled.", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == "GET" {
+		if did := r.URL.Query().Get("did"); did != "" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"did": did, "opted_out": self.Consent.OptedOut(did)})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"count": self.Consent.Count()})
+		return
+	}
+	if r.Method != "POST" && r.Method != "DELETE" {
+		self.ErrorAndReturnCode(w, "Method not allowed.", 405)
+		return
+	}
+	dids := r.URL.Query()["did"]
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		r.ParseForm()
+		dids = r.Form["did"]
+	} else {
+		scanner := bufio.NewScanner(io.LimitReader(r.Body, self.MaxFileSize))
+		for scanner.Scan() {
+			dids = append(dids, scanner.Text())
+		}
+	}
+	changed, err := self.Consent.Update(dids, r.Method == "POST")
+	if err != nil {
+		self.logger.WithFields(logrus.Fields{
+			"module": "consent",
+		}).Errorln("Failed to save opt-out file:", err)
+		self.ErrorAndReturnCode(w, "Failed to save opt-out list:"+err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"changed": changed, "count": self.Consent.Count()})
+}
@@ -0,0 +1,130 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"reflect"
+	"testing"
+)
+
+func TestConsentApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		event  Event
+		want   Event
+		err    error
+	}{
+		{
+			name:   "consented events are kept",
+			policy: ConsentDrop,
+			event:  Event{"did": "abc", "lat": "0"},
+			want:   Event{"did": "abc", "lat": "0"},
+		},
+		{
+			name:   "drop limit ad tracking",
+			policy: ConsentDrop,
+			event:  Event{"did": "abc", "lat": "true"},
+			err:    ErrDropped,
+		},
+		{
+			name:   "strip the identifiers",
+			policy: ConsentStrip,
+			event:  Event{"did": "abc", "ip": "81.2.69.160", "user_agent": "curl", "idfa": "x", "gdpr": "1"},
+			want:   Event{"did": "", "ip": "", "gdpr": "1", "opt_out": "gdpr"},
+		},
+		{
+			name:   "route to the restricted topic",
+			policy: ConsentRoute,
+			event:  Event{"did": "abc", "lat": "1"},
+			want:   Event{"did": "abc", "lat": "1", TopicField: "restricted", "opt_out": "lat"},
+		},
+		{
+			name:   "opted out in another format",
+			policy: ConsentDrop,
+			event:  Event{"did": "6D92078A8246C22D59AD1BA1A0D3AB56"},
+			err:    ErrDropped,
+		},
+	}
+	for _, test := range tests {
+		consent := NewConsentChecker(logrus.New(), consent_config{Policy: test.policy, Restricted_topic: "restricted"})
+		consent.Update([]string{"6d92078a-8246-c22d-59ad-1ba1a0d3ab56"}, true)
+		err := consent.Apply(test.event)
+		if err != test.err {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(test.event, test.want) {
+			t.Errorf("%s: event = %v, want %v", test.name, test.event, test.want)
+		}
+	}
+}
+
+func TestConsentStripEnrichment(t *testing.T) {
+	consent := NewConsentChecker(logrus.New(), consent_config{Policy: ConsentStrip})
+	event := Event{"did": "abc", "lat": "1"}
+	consent.Apply(event)
+	if !consent.Stripped(event) {
+		t.Fatal("event is not stripped")
+	}
+	fields := map[string]bool{}
+	for k := range event {
+		fields[k] = true
+	}
+	event["geo_city"] = "London"
+	event[TopicField] = "scripted"
+	consent.StripEnrichment(event, fields)
+	want := Event{"did": "", "lat": "1", "opt_out": "lat", TopicField: "scripted"}
+	if !reflect.DeepEqual(event, want) {
+		t.Errorf("event = %v, want %v", event, want)
+	}
+}
+
+func TestDeviceIdConsent(t *testing.T) {
+	normalizer := NewDeviceIdNormalizer(logrus.New(), device_id_config{Zeroed: "reject", Unknown: "reject"})
+	tests := []struct {
+		name  string
+		event Event
+		flag  string
+		fail  bool
+	}{
+		{name: "zeroed id is rejected", event: Event{"did": "00000000-0000-0000-0000-000000000000"}, fail: true},
+		{name: "zeroed id with consent is flagged", event: Event{"did": "00000000-0000-0000-0000-000000000000", "opt_out": "lat"}, flag: "zeroed"},
+		{name: "unknown id is rejected", event: Event{"did": "xyz"}, fail: true},
+		{name: "unknown id with consent is flagged", event: Event{"did": "xyz", "opt_out": "gdpr"}, flag: "unknown"},
+		{name: "stripped id is skipped", event: Event{"did": "", "opt_out": "lat"}},
+	}
+	for _, test := range tests {
+		err := normalizer.NormalizeEvent(test.event)
+		if (err != nil) != test.fail {
+			t.Errorf("%s: err = %v", test.name, err)
+			continue
+		}
+		if flag := test.event.String("did_flag"); flag != test.flag {
+			t.Errorf("%s: did_flag = %q, want %q", test.name, flag, test.flag)
+		}
+	}
+}
+
+// the scripts run after the consent policy, they can not move an opted out
+// event to another topic or clear its reason
+func TestConsentRouteAfterScripts(t *testing.T) {
+	handler, producer := newTestHandler(t)
+	handler.Consent = NewConsentChecker(logrus.New(), consent_config{Policy: ConsentRoute, Restricted_topic: "restricted"})
+	handler.Enrichers = append(handler.Enrichers, newTestScript(t, `function process(event) { delete event.extension.opt_out; return "large-orders"; }`, script_config{}))
+	events := []Event{
+		{"did": "a", "timestamp": "1456000000", "event_type": "order", "lat": "1"},
+		{"did": "b", "timestamp": "1456000000", "event_type": "order"},
+	}
+	for _, event := range events {
+		if _, _, err := handler.SendEvent(event, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(producer.messages) != 2 || producer.messages[0].Topic != "restricted" || producer.messages[1].Topic != "large-orders" {
+		t.Fatalf("messages = %v", producer.messages)
+	}
+	extension, _ := producer.records(t, handler)[0]["extension"].(map[string]interface{})
+	if extension["opt_out"] != "lat" {
+		t.Errorf("extension = %v", extension)
+	}
+}
@@ -0,0 +1,185 @@
+package eventtracker
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+)
+
+const (
+	// MaxReportErrors is the maximum number of line errors kept in an upload report
+	MaxReportErrors = 1000
+	// MaxReportRecords is the maximum number of records kept in a dry run report
+	MaxReportRecords = 10000
+)
+
+// LineError is the error of one line of the upload file
+type LineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// UploadReport is the result of an uploaded csv file
+type UploadReport struct {
+	// Accepted lines have been written to kafka
+	Accepted int `json:"accepted"`
+	// Rejected lines are invalid and have been dropped
+	Rejected int `json:"rejected"`
+	// Spooled lines failed to be written to kafka and have been written
+	// to the backup file
+	Spooled int `json:"spooled"`
+	// Duplicates have been received within the dedup window and are dropped
+	Duplicates int `json:"duplicates"`
+	// Dropped lines are dropped by a script or the consent policy
+	Dropped int         `json:"dropped"`
+	Errors  []LineError `json:"errors"`
+	// Records are the decoded avro records in dry run mode
+	Records []map[string]interface{} `json:"records,omitempty"`
+}
+
+func (self *UploadReport) addError(line int, err error) {
+	if err, ok := err.(*HandlerError); ok && err.Spooled {
+		self.Spooled++
+	} else {
+		self.Rejected++
+	}
+	if len(self.Errors) < MaxReportErrors {
+		self.Errors = append(self.Errors, LineError{Line: line, Error: err.Error()})
+	}
+}
+
+func (self *UploadReport) copy() *UploadReport {
+	report := *self
+	report.Errors = append([]LineError{}, self.Errors...)
+	return &report
+}
+
+// ImportOptions controls how a csv file is imported
+type ImportOptions struct {
+	// Strict stops the import at the first error
+	Strict bool
+	// DryRun checks and encodes every line without sending it to kafka
+	DryRun bool
+	// Profile is the name of the column profile, empty for the default
+	Profile string
+	// Client is the authenticated sender of the file, recorded in every line
+	Client *Client
+	// Ip is the address of the sender, the lines are rate limited by it and
+	// by the client
+	Ip string
+	// Report continues a previous report instead of a new one
+	Report *UploadReport
+	// Resume skips the lines up to and including this line number
+	Resume int
+	// Progress is called every ProgressInterval lines with the last line number
+	Progress         func(line int, report *UploadReport)
+	ProgressInterval int
+}
+
+// ColumnMapper returns the column mapper of a profile
+func (self *DefaultHandler) ColumnMapper(profile string) (*ColumnMapper, error) {
+	if mapper, ok := self.Profiles[profile]; ok {
+		return mapper, nil
+	}
+	if profile != "" {
+		return nil, &HandlerError{Code: 400, Msg: "Unknown upload profile: " + profile}
+	}
+	return &ColumnMapper{}, nil
+}
+
+// ImportCSV reads the csv file and sends every line to kafka. The first line
+// is the title. Bad lines are recorded in the report and skipped, unless
+// strict is set, in which case the import stops at the first error. The
+// returned error is only set when the import is aborted.
+func (self *DefaultHandler) ImportCSV(file io.Reader, opt ImportOptions) (*UploadReport, error) {
+	report := opt.Report
+	if report == nil {
+		report = &UploadReport{Errors: []LineError{}}
+	}
+	mapper, err := self.ColumnMapper(opt.Profile)
+	if err != nil {
+		return report, err
+	}
+	csvreader := csv.NewReader(file)
+	title, err := csvreader.Read()
+	if err != nil {
+		return report, &HandlerError{Code: 400, Msg: "Failed to read the first line of file:" + err.Error()}
+	}
+	// map and check the title
+	header := Event{}
+	for k, v := range title {
+		if title[k] = mapper.Field(v); title[k] != "" {
+			header[title[k]] = v
+		}
+	}
+	if err = header.CheckRequired(); err != nil {
+		return report, err
+	}
+	// read the record one by one and send it to kafka
+	for line := 2; ; line++ {
+		record, err := csvreader.Read()
+		if err == io.EOF {
+			break
+		}
+		// only the bad lines can be skipped, the reader can not go on after
+		// an io error, e.g. a truncated gzip file
+		if _, ok := err.(*csv.ParseError); err != nil && !ok {
+			return report, &HandlerError{Code: 400, Msg: fmt.Sprintf("line %d: Err read file:%s", line, err)}
+		}
+		if opt.Progress != nil && opt.ProgressInterval > 0 && line%opt.ProgressInterval == 0 {
+			opt.Progress(line-1, report)
+		}
+		if line <= opt.Resume {
+			continue
+		}
+		if err == nil {
+			err = self.importLine(mapper, title, record, opt, report)
+		} else {
+			err = &HandlerError{Code: 400, Msg: "Err read file:" + err.Error()}
+		}
+		if err == ErrDuplicate {
+			report.Duplicates++
+			continue
+		} else if err == ErrDropped {
+			report.Dropped++
+			continue
+		} else if err != nil {
+			if opt.Strict {
+				return report, &HandlerError{Code: ErrorCode(err), Msg: fmt.Sprintf("line %d: %s", line, err)}
+			}
+			report.addError(line, err)
+			continue
+		}
+		report.Accepted++
+	}
+	return report, nil
+}
+
+// importLine sends one line of the csv file to kafka, or only checks it in
+// dry run mode
+func (self *DefaultHandler) importLine(mapper *ColumnMapper, title, record []string, opt ImportOptions, report *UploadReport) error {
+	var err error
+	event := Event{}
+	for k, v := range title {
+		if v == "" {
+			continue
+		}
+		if event[v], err = mapper.Value(v, record[k]); err != nil {
+			return &HandlerError{Code: 400, Msg: err.Error()}
+		}
+	}
+	// the file can not declare the observed ip
+	event.SetClientIP("")
+	if self.Auth != nil {
+		event.SetClient(opt.Client)
+	}
+	if !opt.DryRun {
+		_, _, err = self.SendEvent(event, &EventSource{Endpoint: "/upload", Ip: opt.Ip, Client: opt.Client})
+		return err
+	}
+	fields, err := self.CheckEvent(event)
+	if err == nil && len(report.Records) < MaxReportRecords {
+		report.Records = append(report.Records, fields)
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package eventtracker
+
+import (
+	"errors"
+	"github.com/lixin9311/logrus"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testCSV = `did,timestamp,event_type,channel
+a,1456000000,open,ads
+b,yesterday,open,ads
+c,1456000000,open
+d,1456000000,open,organic
+`
+
+func TestImportCSV(t *testing.T) {
+	tests := []struct {
+		name     string
+		csv      string
+		opt      ImportOptions
+		fail     bool
+		kafka    bool
+		accepted int
+		rejected int
+		spooled  int
+		lines    []int
+		sent     int
+	}{
+		{
+			name:     "bad lines are skipped",
+			csv:      testCSV,
+			accepted: 2, rejected: 2, lines: []int{3, 4}, sent: 2,
+		},
+		{
+			name: "strict stops at the first error",
+			csv:  testCSV,
+			opt:  ImportOptions{Strict: true},
+			fail: true, accepted: 1, sent: 1,
+		},
+		{
+			name:     "dry run sends nothing",
+			csv:      testCSV,
+			opt:      ImportOptions{DryRun: true},
+			accepted: 2, rejected: 2, lines: []int{3, 4},
+		},
+		{
+			name:     "resume skips the imported lines",
+			csv:      testCSV,
+			opt:      ImportOptions{Resume: 3},
+			accepted: 1, rejected: 1, lines: []int{4}, sent: 1,
+		},
+		{
+			name:    "kafka failures are spooled",
+			csv:     "did,timestamp,event_type\na,1456000000,open\n",
+			kafka:   true,
+			spooled: 1, lines: []int{2},
+		},
+		{
+			name: "missing required columns",
+			csv:  "did,event_type\na,open\n",
+			fail: true,
+		},
+	}
+	for _, test := range tests {
+		handler, producer := newTestHandler(t)
+		handler.Timestamps = NewTimestampNormalizer(logrus.New(), timestamp_config{})
+		producer.fail = test.kafka
+		report, err := handler.ImportCSV(strings.NewReader(test.csv), test.opt)
+		if (err != nil) != test.fail {
+			t.Errorf("%s: err = %v", test.name, err)
+			continue
+		}
+		var lines []int
+		for _, e := range report.Errors {
+			lines = append(lines, e.Line)
+		}
+		if report.Accepted != test.accepted || report.Rejected != test.rejected || report.Spooled != test.spooled || !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%s: report = %+v", test.name, report)
+		}
+		if len(producer.messages) != test.sent {
+			t.Errorf("%s: %d messages sent, want %d", test.name, len(producer.messages), test.sent)
+		}
+		if test.opt.DryRun && len(report.Records) != test.accepted {
+			t.Errorf("%s: %d records", test.name, len(report.Records))
+		}
+	}
+}
+
+func TestImportCSVDuplicates(t *testing.T) {
+	handler, producer := newTestHandler(t)
+	handler.Dedup = NewDeduplicator(logrus.New(), dedup_config{Window: "1h"})
+	csv := "did,timestamp,event_type,event_id\na,1456000000,open,e1\na,1456000000,open,e1\n"
+	report, err := handler.ImportCSV(strings.NewReader(csv), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Accepted != 1 || report.Duplicates != 1 || len(producer.messages) != 1 {
+		t.Errorf("report = %+v, %d messages", report, len(producer.messages))
+	}
+}
+
+// failingReader fails after the data, like a truncated gzip file
+type failingReader struct {
+	io.Reader
+}
+
+func (self *failingReader) Read(p []byte) (int, error) {
+	n, err := self.Reader.Read(p)
+	if err == io.EOF {
+		return n, errors.New("unexpected EOF")
+	}
+	return n, err
+}
+
+func TestImportCSVReadError(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	report, err := handler.ImportCSV(&failingReader{strings.NewReader("did,timestamp,event_type\na,1456000000,open\n")}, ImportOptions{})
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("err = %v, want an abort at line 3", err)
+	}
+	if report.Accepted != 1 {
+		t.Errorf("report = %+v", report)
+	}
+}
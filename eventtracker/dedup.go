@@ -0,0 +1,207 @@
+package eventtracker
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/lixin9311/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+type dedup_config struct {
+	Enabled bool
+	// Window is how long an event is remembered, in go duration format
+	Window string
+	// Max_entries is the size of the lru
+	Max_entries int
+	// File persists the lru, empty to keep it in memory only
+	File string
+	// Save_interval is the interval to save the lru to the file
+	Save_interval string
+}
+
+// ErrDuplicate is returned when an event has been received within the
+// dedup window, it is not an error for the client
+var ErrDuplicate = &HandlerError{Code: 200, Msg: "Duplicate event."}
+
+type dedupEntry struct {
+	Key  string    `json:"key"`
+	Id   string    `json:"id"`
+	Seen time.Time `json:"seen"`
+}
+
+// Deduplicator remembers the events received within the window in a lru
+type Deduplicator struct {
+	sync.Mutex
+	window  time.Duration
+	max     int
+	file    string
+	entries map[string]*list.Element
+	lru     *list.List
+	logger  *logrus.Logger
+}
+
+// NewDeduplicator makes a deduplicator, the saved entries are loaded from
+// the file
+func NewDeduplicator(w *logrus.Logger, conf dedup_config) *Deduplicator {
+	window, err := time.ParseDuration(conf.Window)
+	if err != nil {
+		w.WithFields(logrus.Fields{
+			"module": "dedup",
+		}).Fatalln("Invalid dedup window:", err)
+	}
+	self := &Deduplicator{window: window, max: conf.Max_entries, file: conf.File, entries: map[string]*list.Element{}, lru: list.New(), logger: w}
+	if self.max <= 0 {
+		self.max = 1000000
+	}
+	if self.file == "" {
+		return self
+	}
+	if err = self.load(); err != nil {
+		w.WithFields(logrus.Fields{
+			"module": "dedup",
+		}).Fatalln("Failed to load dedup file:", err)
+	}
+	interval := 10 * time.Second
+	if conf.Save_interval != "" {
+		if interval, err = time.ParseDuration(conf.Save_interval); err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "dedup",
+			}).Fatalln("Invalid dedup save_interval:", err)
+		}
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := self.Save(); err != nil {
+				w.WithFields(logrus.Fields{
+					"module": "dedup",
+				}).Errorln("Failed to save dedup file:", err)
+			}
+		}
+	}()
+	w.WithFields(logrus.Fields{
+		"module": "dedup",
+	}).Infof("Init completed, %d entries loaded.\n", self.lru.Len())
+	return self
+}
+
+// DedupKey returns the dedup key of an event, the client event_id if
+// provided, otherwise a hash of did, event_type and timestamp. The timestamp
+// is parsed and the did is normalized, so the same time sent in different
+// units or the same did in another case has the same key. The key is
+// prefixed with the authenticated client, so the clients do not drop the
+// events of each other.
+func DedupKey(event Event) string {
+	client := event.String("client_id")
+	if id := event.String("event_id"); id != "" {
+		return "id:" + client + "\x00" + id
+	}
+	timestamp := event.String("timestamp")
+	if t, err := ParseTimestamp(timestamp); err == nil {
+		timestamp = t.Format(time.RFC3339Nano)
+	}
+	did := event.String("did")
+	if normalized, _, ok := NormalizeDeviceId(did, event.String("did_type"), platformHint(event)); ok {
+		did = normalized
+	}
+	sum := sha1.Sum([]byte(client + "\x00" + did + "\x00" + event.EventType() + "\x00" + timestamp))
+	return "hash:" + hex.EncodeToString(sum[:])
+}
+
+// Reserve remembers the key with the event id. If the key has been seen
+// within the window, the id of the first event is returned and dup is set.
+func (self *Deduplicator) Reserve(key, id string) (first string, dup bool) {
+	self.Lock()
+	defer self.Unlock()
+	now := time.Now()
+	if elem, ok := self.entries[key]; ok {
+		entry := elem.Value.(*dedupEntry)
+		if now.Sub(entry.Seen) < self.window {
+			return entry.Id, true
+		}
+	}
+	self.add(&dedupEntry{Key: key, Id: id, Seen: now})
+	return id, false
+}
+
+// Release forgets a key, used when the event failed to be written
+func (self *Deduplicator) Release(key string) {
+	self.Lock()
+	defer self.Unlock()
+	if elem, ok := self.entries[key]; ok {
+		self.lru.Remove(elem)
+		delete(self.entries, key)
+	}
+}
+
+// add inserts an entry and evicts the oldest ones, the caller must hold the lock
+func (self *Deduplicator) add(entry *dedupEntry) {
+	if elem, ok := self.entries[entry.Key]; ok {
+		self.lru.Remove(elem)
+	}
+	self.entries[entry.Key] = self.lru.PushFront(entry)
+	for self.lru.Len() > self.max {
+		oldest := self.lru.Back()
+		self.lru.Remove(oldest)
+		delete(self.entries, oldest.Value.(*dedupEntry).Key)
+	}
+}
+
+// Save writes the entries within the window to the file
+func (self *Deduplicator) Save() error {
+	tmp := self.file + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	self.Lock()
+	now := time.Now()
+	// oldest first, so the order is kept when loading
+	for elem := self.lru.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*dedupEntry)
+		if now.Sub(entry.Seen) >= self.window {
+			continue
+		}
+		encoder.Encode(entry)
+	}
+	self.Unlock()
+	if err = writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, self.file)
+}
+
+// load reads the entries within the window from the file
+func (self *Deduplicator) load() error {
+	file, err := os.Open(self.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	now := time.Now()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry := &dedupEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			continue
+		}
+		if now.Sub(entry.Seen) >= self.window {
+			continue
+		}
+		self.add(entry)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,112 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDedupKey(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Event
+		same bool
+	}{
+		{
+			name: "same event_id",
+			a:    Event{"event_id": "e1", "did": "a"},
+			b:    Event{"event_id": "e1", "did": "b"},
+			same: true,
+		},
+		{
+			name: "event_id of other clients",
+			a:    Event{"event_id": "e1", "client_id": "c1"},
+			b:    Event{"event_id": "e1", "client_id": "c2"},
+		},
+		{
+			name: "same time in different units",
+			a:    Event{"did": "a", "event_type": "click", "timestamp": "1456000000"},
+			b:    Event{"did": "a", "event_type": "click", "timestamp": "1456000000000"},
+			same: true,
+		},
+		{
+			name: "hash of other clients",
+			a:    Event{"did": "a", "event_type": "click", "timestamp": "1456000000", "client_id": "c1"},
+			b:    Event{"did": "a", "event_type": "click", "timestamp": "1456000000", "client_id": "c2"},
+		},
+		{
+			name: "did in another case",
+			a:    Event{"did": "6D92078A-8246-C22D-59AD-1BA1A0D3AB56", "event_type": "click", "timestamp": "1456000000"},
+			b:    Event{"did": "6d92078a-8246-c22d-59ad-1ba1a0d3ab56", "event_type": "click", "timestamp": "1456000000"},
+			same: true,
+		},
+		{
+			name: "different event types",
+			a:    Event{"did": "a", "event_type": "click", "timestamp": "1456000000"},
+			b:    Event{"did": "a", "event_type": "install", "timestamp": "1456000000"},
+		},
+	}
+	for _, test := range tests {
+		if same := DedupKey(test.a) == DedupKey(test.b); same != test.same {
+			t.Errorf("%s: same key = %v, want %v", test.name, same, test.same)
+		}
+	}
+}
+
+func TestDeduplicator(t *testing.T) {
+	dedup := NewDeduplicator(logrus.New(), dedup_config{Window: "1h", Max_entries: 2})
+	tests := []struct {
+		name  string
+		op    func() (string, bool)
+		first string
+		dup   bool
+	}{
+		{name: "new key", op: func() (string, bool) { return dedup.Reserve("a", "1") }, first: "1"},
+		{name: "duplicate", op: func() (string, bool) { return dedup.Reserve("a", "2") }, first: "1", dup: true},
+		{name: "released", op: func() (string, bool) { dedup.Release("a"); return dedup.Reserve("a", "3") }, first: "3"},
+		{name: "evicted", op: func() (string, bool) {
+			dedup.Reserve("b", "4")
+			dedup.Reserve("c", "5")
+			return dedup.Reserve("a", "6")
+		}, first: "6"},
+		{name: "kept", op: func() (string, bool) { return dedup.Reserve("c", "7") }, first: "5", dup: true},
+	}
+	for _, test := range tests {
+		if first, dup := test.op(); first != test.first || dup != test.dup {
+			t.Errorf("%s: %s %v, want %s %v", test.name, first, dup, test.first, test.dup)
+		}
+	}
+}
+
+func TestDeduplicatorWindow(t *testing.T) {
+	dedup := NewDeduplicator(logrus.New(), dedup_config{Window: "1h"})
+	dedup.add(&dedupEntry{Key: "old", Id: "1", Seen: time.Now().Add(-2 * time.Hour)})
+	if first, dup := dedup.Reserve("old", "2"); dup || first != "2" {
+		t.Errorf("the key out of the window is a duplicate of %s", first)
+	}
+}
+
+func TestDeduplicatorSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := dedup_config{Window: "1h", File: filepath.Join(dir, "dedup.json"), Save_interval: "1h"}
+	dedup := NewDeduplicator(logrus.New(), conf)
+	dedup.Reserve("a", "1")
+	dedup.add(&dedupEntry{Key: "old", Id: "2", Seen: time.Now().Add(-2 * time.Hour)})
+	if err = dedup.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewDeduplicator(logrus.New(), conf)
+	if first, dup := loaded.Reserve("a", "3"); !dup || first != "1" {
+		t.Errorf("saved key: %s %v", first, dup)
+	}
+	if _, dup := loaded.Reserve("old", "4"); dup {
+		t.Error("the key out of the window is saved")
+	}
+}
@@ -2,13 +2,16 @@ package eventtracker
 
 import (
 	"bytes"
-	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/linkedin/goavro"
 	"github.com/lixin9311/logrus"
 	"html/template"
-	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
 )
 
@@ -18,13 +21,52 @@ type DefaultHandler struct {
 	MaxFileSize int64
 	// MaxMemorySize is the maximum memory size to handle the upload file
 	MaxMemorySize int64
-	fail_safe     *log.Logger
-	kafka         *Kafka
-	avro          *Avro
+	// MaxStreamLines is the maximum lines of one stream request
+	MaxStreamLines int
+	// MaxStreamLineSize is the maximum size of one line of the stream request
+	MaxStreamLineSize int
+	// StreamProgressInterval is the number of lines between two progress reports
+	StreamProgressInterval int
+	// Proxies resolves the client ip behind trusted proxies, nil to use the
+	// peer address
+	Proxies *IPResolver
+	// MultiValue decides how repeated form parameters are kept, nil to keep
+	// the first value only
+	MultiValue *MultiValuePolicy
+	// Auth checks the api keys and the event types of the clients, nil if not
+	// enabled
+	Auth *Authenticator
+	// RateLimiter limits the requests and the events, nil if not enabled
+	RateLimiter *RateLimiter
+	// Transformer rewrites the fields of each event type, nil to skip
+	Transformer *EventTransformer
+	// Validator checks the rules of each event type, nil to skip
+	Validator *EventValidator
+	// Timestamps normalizes the timestamp of every event, nil to keep it as is
+	Timestamps *TimestampNormalizer
+	// DeviceIds normalizes the did of every event, nil to keep it as is
+	DeviceIds *DeviceIdNormalizer
+	// Enrichers add fields to every event before it is encoded
+	Enrichers []Enricher
+	// Consent applies the opt-out policy after the enrichment, nil if not enabled
+	Consent *ConsentChecker
+	// PII protects the personal fields after the enrichment, nil to keep them
+	PII *PIIProtector
+	// Dedup drops the events received within the dedup window, nil if not enabled
+	Dedup *Deduplicator
+	// Clicks checks the destinations of the click endpoint, nil if not enabled
+	Clicks *ClickRedirector
+	// Profiles are the column mappers of the upload api
+	Profiles map[string]*ColumnMapper
+	// Jobs runs the asynchronous uploads, nil if not enabled
+	Jobs      *UploadJobs
+	fail_safe *log.Logger
+	kafka     *Kafka
+	avro      *Avro
 }
 
 func NewDefaultHandler(w *logrus.Logger, fail_safe *log.Logger, kafka *Kafka, avro *Avro) *DefaultHandler {
-	return &DefaultHandler{logger: w, MaxFileSize: int64(10 * 1024 * 1024), MaxMemorySize: int64(10 * 1024 * 1024), fail_safe: fail_safe, kafka: kafka, avro: avro}
+	return &DefaultHandler{logger: w, MaxFileSize: int64(10 * 1024 * 1024), MaxMemorySize: int64(10 * 1024 * 1024), MaxStreamLines: 1000000, MaxStreamLineSize: 1024 * 1024, StreamProgressInterval: 10000, fail_safe: fail_safe, kafka: kafka, avro: avro}
 }
 
 func (self *DefaultHandler) PingHandler(w http.ResponseWriter, r *http.Request) {
@@ -46,6 +88,36 @@ func (self *DefaultHandler) HomeHandler(w http.ResponseWriter, r *http.Request)
 	t.Execute(w, nil)
 }
 
+// ClientIP returns the ip of the client of the request
+func (self *DefaultHandler) ClientIP(r *http.Request) string {
+	if self.Proxies == nil {
+		return RemoteIP(r)
+	}
+	return self.Proxies.ClientIP(r)
+}
+
+// setRequestFields records the client ip, the user agent if it is parsed,
+// and the authenticated client of the request in the event
+func (self *DefaultHandler) setRequestFields(event Event, r *http.Request) {
+	event.SetClientIP(self.ClientIP(r))
+	if self.parsesUserAgent() {
+		event.SetUserAgent(r.UserAgent())
+	}
+	if self.Auth != nil {
+		event.SetClient(ClientFromRequest(r))
+	}
+}
+
+// parsesUserAgent reports whether the user agent parser is enabled
+func (self *DefaultHandler) parsesUserAgent() bool {
+	for _, enricher := range self.Enrichers {
+		if _, ok := enricher.(*UserAgentParser); ok {
+			return true
+		}
+	}
+	return false
+}
+
 // ErrorAndReturnCode prints an error and reponse to http client
 func (self *DefaultHandler) ErrorAndReturnCode(w http.ResponseWriter, errstr string, code int) {
 	self.logger.WithFields(logrus.Fields{
@@ -54,197 +126,437 @@ func (self *DefaultHandler) ErrorAndReturnCode(w http.ResponseWriter, errstr str
 	http.Error(w, errstr, code)
 }
 
-// UploadHandler handles the upload file
-func (self *DefaultHandler) UploadHandler(w http.ResponseWriter, r *http.Request) {
-	var remote string
-	if tmp := r.Header.Get("X-Forwarded-For"); tmp != "" {
-		remote = tmp
-	} else {
-		remote = r.RemoteAddr
+// writeError responds with the status code of the error, the Retry-After
+// header is set if the error is rate limited
+func (self *DefaultHandler) writeError(w http.ResponseWriter, err error) {
+	if retry := ErrorRetryAfter(err); retry > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
 	}
-	self.logger.WithFields(logrus.Fields{
-		"module": "Handler",
-	}).Debugln("Incomming upload file from:", remote, "With Header:", r.Header)
-	// limit the file size
-	if r.ContentLength > self.MaxFileSize {
-		self.ErrorAndReturnCode(w, "The file is too large:"+strconv.FormatInt(r.ContentLength, 10)+"bytes", 400)
-		return
+	self.ErrorAndReturnCode(w, err.Error(), ErrorCode(err))
+}
+
+// EventResult is the result of one event written by the json api
+type EventResult struct {
+	Id        string `json:"id"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Code      int    `json:"code"`
+	Error     string `json:"error,omitempty"`
+	// Violations lists the failed validation rules
+	Violations []string `json:"violations,omitempty"`
+	// Duplicate is set when the event has been received before and is dropped
+	Duplicate bool `json:"duplicate,omitempty"`
+	// Dropped is set when the event is dropped by a script or the consent policy
+	Dropped bool `json:"dropped,omitempty"`
+	// Topic is the kafka topic chosen by a script or the consent policy
+	Topic string `json:"topic,omitempty"`
+	// Record is the decoded avro record in dry run mode
+	Record map[string]interface{} `json:"record,omitempty"`
+}
+
+// NewEventRecord converts an event to an avro record
+func (self *DefaultHandler) NewEventRecord(event Event) (*goavro.Record, error) {
+	record, _, err := self.newEventRecord(event, nil)
+	return record, err
+}
+
+// newEventRecord converts an event to an avro record, and returns the dedup
+// key of the event checked and normalized, before the consent policy and the
+// enrichers change it. The events of a public source are not checked against
+// the authenticated clients.
+func (self *DefaultHandler) newEventRecord(event Event, source *EventSource) (*goavro.Record, string, error) {
+	// the topic can only be chosen by the scripts, and the opt_out reason is
+	// only set by the consent policy
+	delete(event, TopicField)
+	delete(event, "opt_out")
+	if self.Transformer != nil {
+		self.Transformer.Transform(event)
 	}
-	r.Body = http.MaxBytesReader(w, r.Body, self.MaxFileSize)
-	err := r.ParseMultipartForm(self.MaxMemorySize)
-	if err != nil {
-		self.ErrorAndReturnCode(w, "Failed to parse form:"+err.Error(), 500)
-		return
+	if err := event.CheckRequired(); err != nil {
+		return nil, "", err
 	}
-	// get the file
-	file, _, err := r.FormFile("uploadfile")
-	if err != nil {
-		self.ErrorAndReturnCode(w, "Failed to read upload file:"+err.Error(), 500)
-		return
+	if self.Auth != nil && (source == nil || !source.Public) {
+		if err := self.Auth.Check(event); err != nil {
+			return nil, "", err
+		}
 	}
-	defer file.Close()
-	// read the file
-	csvreader := csv.NewReader(file)
-	record, err := csvreader.Read()
+	if self.Validator != nil {
+		if err := self.Validator.Validate(event); err != nil {
+			return nil, "", err
+		}
+	}
+	if self.Timestamps != nil {
+		if err := self.Timestamps.NormalizeEvent(event); err != nil {
+			return nil, "", err
+		}
+	}
+	var key string
+	if self.Dedup != nil {
+		key = DedupKey(event)
+	}
+	var reason string
+	if self.Consent != nil {
+		if err := self.Consent.Apply(event); err != nil {
+			return nil, "", err
+		}
+		reason = event.String("opt_out")
+	}
+	if self.DeviceIds != nil {
+		if err := self.DeviceIds.NormalizeEvent(event); err != nil {
+			return nil, "", err
+		}
+	}
+	// the enrichment of the stripped events is removed afterwards
+	var fields map[string]bool
+	if self.Consent != nil && self.Consent.Stripped(event) {
+		fields = map[string]bool{}
+		for k := range event {
+			fields[k] = true
+		}
+	}
+	for _, enricher := range self.Enrichers {
+		if err := enricher.Enrich(event); err != nil {
+			return nil, "", err
+		}
+	}
+	if fields != nil {
+		self.Consent.StripEnrichment(event, fields)
+	}
+	if self.Consent != nil {
+		self.Consent.Enforce(event, reason)
+	}
+	// the arrays set by the scripts follow the multi value policy as well
+	if self.MultiValue != nil {
+		self.MultiValue.Apply(event)
+	}
+	if self.PII != nil {
+		if err := self.PII.Protect(event); err != nil {
+			return nil, "", err
+		}
+	}
+	id := event.Id()
+	if len(id) > MaxEventIdLength {
+		return nil, "", &HandlerError{Code: 400, Msg: "event_id is too long"}
+	}
+	record, err := self.avro.NewRecord()
 	if err != nil {
-		self.ErrorAndReturnCode(w, "Failed to read the first line of file:"+err.Error(), 500)
-		return
+		return nil, "", &HandlerError{Code: 500, Msg: "Failed to set a new avro record:" + err.Error()}
 	}
-	title := map[string]int{}
-	ext := map[string]int{}
 	extension := map[string](interface{}){}
-	// read title and extensions
-	for k, v := range record {
-		if v == "did" || v == "aid" || v == "ip" || v == "timestamp" {
-			title[v] = k
+	for k, v := range event {
+		if k == "event_id" || k == TopicField {
+			continue
+		} else if IsTopLevelField(k) {
+			record.Set(k, v)
 		} else {
-			ext[v] = k
+			extension[k] = v
 		}
 	}
-	if _, ok := title["did"]; !ok {
-		self.ErrorAndReturnCode(w, "Missing Required field: No did", 400)
-		return
+	if len(extension) != 0 {
+		record.Set("extension", extension)
 	}
-	if _, ok := title["timestamp"]; !ok {
-		self.ErrorAndReturnCode(w, "Missing Required field: No timestamp", 400)
-		return
+	// fullfill the event.avsc required fields
+	record.Set("event", "TrackerEvent")
+	record.Set("id", id)
+	return record, key, nil
+}
+
+// EncodeEvent converts an event to an avro record and encodes it
+func (self *DefaultHandler) EncodeEvent(event Event) (*goavro.Record, []byte, error) {
+	record, data, _, err := self.encodeEvent(event, nil)
+	return record, data, err
+}
+
+// encodeEvent converts an event to an avro record and encodes it, the dedup
+// key of the event is returned as well
+func (self *DefaultHandler) encodeEvent(event Event, source *EventSource) (*goavro.Record, []byte, string, error) {
+	record, key, err := self.newEventRecord(event, source)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	self.logger.WithFields(logrus.Fields{
+		"module": "Handler",
+	}).Debugln("Generated AVRO record:", record)
+	// encode avro
+	buf := new(bytes.Buffer)
+	if err = self.avro.Encode(buf, record); err != nil {
+		return nil, nil, "", &HandlerError{Code: 400, Msg: "Failed to encode avro record:" + err.Error()}
+	}
+	return record, buf.Bytes(), key, nil
+}
+
+// CheckEvent encodes an event without sending it, and returns the fields of
+// the decoded avro record
+func (self *DefaultHandler) CheckEvent(event Event) (map[string]interface{}, error) {
+	_, data, err := self.EncodeEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := self.avro.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, &HandlerError{Code: 500, Msg: "Failed to decode avro record:" + err.Error()}
 	}
-	if _, ok := ext["event_type"]; !ok {
-		self.ErrorAndReturnCode(w, "Missing Required field: No event_type", 400)
+	fields := map[string]interface{}{}
+	for _, field := range decoded.Fields {
+		fields[field.Name] = field.Datum
+	}
+	return fields, nil
+}
+
+// SendEvent converts an event to avro and sends it to kafka, the data is
+// written to the backup file if kafka fails. ErrDuplicate is returned if the
+// event has been received within the dedup window, the event_id is set to
+// the id of the first event. The dedup key is computed from the normalized
+// event. Only the events to be sent count against the rate limits of the
+// source, not the dry runs or the rejected events, a nil source is not rate
+// limited.
+func (self *DefaultHandler) SendEvent(event Event, source *EventSource) (partition int32, offset int64, err error) {
+	record, data, key, err := self.encodeEvent(event, source)
+	if err != nil {
 		return
 	}
-	// read the record one by one and send it to kafka
-	buf := new(bytes.Buffer)
-	counter := 0
-	for {
-		// one more line
-		record, err := csvreader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			self.ErrorAndReturnCode(w, "Err read file:"+err.Error(), 500)
+	if self.Dedup != nil {
+		if first, dup := self.Dedup.Reserve(key, event.Id()); dup {
+			event["event_id"] = first
+			err = ErrDuplicate
 			return
 		}
-		arecord, err := self.avro.NewRecord()
-		if err != nil {
-			self.ErrorAndReturnCode(w, "Failed to set new avro record:"+err.Error(), 500)
-			return
-		}
-		// set main title
-		for k, v := range title {
-			arecord.Set(k, record[v])
-		}
-		// set ext map
-		for k, v := range ext {
-			extension[k] = record[v]
-		}
-		if len(extension) != 0 {
-			arecord.Set("extension", extension)
-		}
-		// fullfill the event.avsc required fields
-		arecord.Set("event", "TrackerEvent")
-		arecord.Set("id", "")
-		// encode avro
-		if err = self.avro.Encode(buf, arecord); err != nil {
-			self.ErrorAndReturnCode(w, "Failed to encode avro record:"+err.Error(), 500)
+	}
+	if self.RateLimiter != nil && source != nil {
+		if err = self.RateLimiter.AllowEvent(event.EventType(), source); err != nil {
+			if self.Dedup != nil {
+				self.Dedup.Release(key)
+			}
 			return
 		}
-		// send to kafka
-		_, _, err = self.kafka.SendByteMessage(buf.Bytes(), record[ext["event_type"]])
-		if err != nil {
-			self.fail_safe.Println("error:", err)
-			self.fail_safe.Println("record:", arecord)
-			self.fail_safe.Println("data:", buf.Bytes())
-			self.ErrorAndReturnCode(w, "Failed to send to kafka:"+err.Error(), 500)
-			return
+	}
+	// send to kafka
+	if topic := event.String(TopicField); topic != "" {
+		partition, offset, err = self.kafka.SendByteMessageToTopic(data, topic)
+	} else {
+		partition, offset, err = self.kafka.SendByteMessage(data, event.EventType())
+	}
+	if err != nil {
+		// the client may retry within the window
+		if self.Dedup != nil {
+			self.Dedup.Release(key)
 		}
-		buf.Reset()
-		counter++
+		self.fail_safe.Println("error:", err)
+		self.fail_safe.Println("record:", record)
+		self.fail_safe.Println("data:", data)
+		err = &HandlerError{Code: 500, Msg: "Failed to send message to kafka:" + err.Error() + "Data has been writen to a backup file. Please contact us.", Spooled: true}
+		return
 	}
-	// done
 	self.logger.WithFields(logrus.Fields{
 		"module": "Handler",
-	}).Debugln("%d messages have been writen.", counter)
-	w.WriteHeader(200)
-	fmt.Fprintf(w, "%d messages have been writen.", counter)
+	}).Debugf("New record partition=%d\toffset=%d\n", partition, offset)
+	return
 }
 
-// EventHandler is the REST api handler
-func (self *DefaultHandler) EventHandler(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
-	var remote string
-	if tmp := r.Header.Get("X-Forwarded-For"); tmp != "" {
-		remote = tmp
-	} else {
-		remote = r.RemoteAddr
-	}
+// UploadHandler handles the upload file
+func (self *DefaultHandler) UploadHandler(w http.ResponseWriter, r *http.Request) {
+	remote := self.ClientIP(r)
 	self.logger.WithFields(logrus.Fields{
 		"module": "Handler",
-	}).Debugln("Incomming event from:", remote, "With Header:", r.Header)
-	// required fields
-	if len(r.Form["did"]) < 1 {
-		self.ErrorAndReturnCode(w, "Missing Required field: No did", 400)
-		return
+	}).Debugln("Incomming upload file from:", remote, "With Header:", RedactHeader(r.Header))
+	// limit the file size, the asynchronous uploads may be larger
+	limit := self.MaxFileSize
+	if self.Jobs != nil && self.Jobs.MaxFileSize > limit {
+		limit = self.Jobs.MaxFileSize
 	}
-	if len(r.Form["timestamp"]) < 1 {
-		self.ErrorAndReturnCode(w, "Missing Required field: No timestamp", 400)
+	if r.ContentLength > limit {
+		self.ErrorAndReturnCode(w, "The file is too large:"+strconv.FormatInt(r.ContentLength, 10)+"bytes", 400)
 		return
 	}
-	if len(r.Form["event_type"]) < 1 {
-		self.ErrorAndReturnCode(w, "Missing Required field: No event_type", 400)
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	err := r.ParseMultipartForm(self.MaxMemorySize)
+	if err != nil {
+		self.ErrorAndReturnCode(w, "Failed to parse form:"+err.Error(), 500)
 		return
 	}
-	// set a new avro record
-	record, err := self.avro.NewRecord()
+	// get the file
+	file, header, err := r.FormFile("uploadfile")
 	if err != nil {
-		self.ErrorAndReturnCode(w, "Failed to set a new avro record:"+err.Error(), 500)
+		self.ErrorAndReturnCode(w, "Failed to read upload file:"+err.Error(), 500)
 		return
 	}
-	// optional fields
-	if len(r.Form["ip"]) > 0 {
-		record.Set("ip", r.Form["ip"][0])
+	defer file.Close()
+	strict := r.FormValue("strict") == "true"
+	dryRun := r.FormValue("dry_run") == "true"
+	async := r.FormValue("async") == "true" && !dryRun
+	profile := r.FormValue("profile")
+	if _, err := self.ColumnMapper(profile); err != nil {
+		self.ErrorAndReturnCode(w, err.Error(), ErrorCode(err))
+		return
 	}
-	if len(r.Form["aid"]) > 0 {
-		record.Set("aid", r.Form["aid"][0])
+	if !async && header.Size > self.MaxFileSize {
+		self.ErrorAndReturnCode(w, "The file is too large:"+strconv.FormatInt(header.Size, 10)+"bytes, use async=true", 400)
+		return
 	}
-	// set required fields
-	record.Set("did", r.Form["did"][0])
-	record.Set("timestamp", r.Form["timestamp"][0])
-	record.Set("event", "TrackerEvent")
-	record.Set("id", "")
-	// extensions fields
-	extension := map[string](interface{}){}
-	for k, v := range r.Form {
-		if k != "ip" && k != "aid" && k != "did" && k != "timestamp" {
-			extension[k] = v[0]
+	if async {
+		if self.Jobs == nil {
+			self.ErrorAndReturnCode(w, "Asynchronous upload is not enabled.", 400)
+			return
+		}
+		job, err := self.Jobs.Submit(file, strict, profile, ClientFromRequest(r), remote)
+		if err != nil {
+			self.ErrorAndReturnCode(w, "Failed to create upload job:"+err.Error(), 500)
+			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(202)
+		json.NewEncoder(w).Encode(job)
+		return
 	}
-	if len(extension) != 0 {
-		record.Set("extension", extension)
+	report, err := self.ImportCSV(file, ImportOptions{Strict: strict, DryRun: dryRun, Profile: profile, Client: ClientFromRequest(r), Ip: remote})
+	if err != nil {
+		self.ErrorAndReturnCode(w, err.Error(), ErrorCode(err))
+		return
 	}
+	// done
 	self.logger.WithFields(logrus.Fields{
 		"module": "Handler",
-	}).Debugln("Generated AVRO record:", record)
-	// encode avro
-	buf := new(bytes.Buffer)
-	if err = self.avro.Encode(buf, record); err != nil {
-		self.ErrorAndReturnCode(w, "Failed to encode avro record:"+err.Error(), 500)
+	}).Debugf("Upload done, accepted=%d\trejected=%d\tspooled=%d\n", report.Accepted, report.Rejected, report.Spooled)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(report)
+}
+
+// UploadJobHandler returns the state of an asynchronous upload
+func (self *DefaultHandler) UploadJobHandler(w http.ResponseWriter, r *http.Request) {
+	if self.Jobs == nil {
+		self.ErrorAndReturnCode(w, "Asynchronous upload is not enabled.", 400)
 		return
 	}
-	// send to kafka
-	part, offset, err := self.kafka.SendByteMessage(buf.Bytes(), r.Form["event_type"][0])
-	if err != nil {
-		self.fail_safe.Println("error:", err)
-		self.fail_safe.Println("record:", record)
-		self.fail_safe.Println("data:", buf.Bytes())
-		self.ErrorAndReturnCode(w, "Failed to send message to kafka:"+err.Error()+"Data has been writen to a backup file. Please contact us.", 500)
+	job, ok := self.Jobs.Get(mux.Vars(r)["id"])
+	// the jobs of other clients are hidden
+	if client := ClientFromRequest(r); ok && client != nil && (job.Client == nil || job.Client.Id != client.Id) {
+		ok = false
+	}
+	if !ok {
+		http.Error(w, "Upload job not found.", 404)
 		return
 	}
-	// done
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// EventHandler is the REST api handler, it accepts form values or a json
+// body with one event object or an array of events
+func (self *DefaultHandler) EventHandler(w http.ResponseWriter, r *http.Request) {
+	remote := self.ClientIP(r)
 	self.logger.WithFields(logrus.Fields{
 		"module": "Handler",
-	}).Debugf("New record partition=%d\toffset=%d\n", part, offset)
+	}).Debugln("Incomming event from:", remote, "With Header:", RedactHeader(r.Header))
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	if mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediatype == "application/json" {
+		r.Body = http.MaxBytesReader(w, r.Body, self.MaxFileSize)
+		events, err := DecodeJSONEvents(r.Body)
+		if err != nil {
+			self.ErrorAndReturnCode(w, "Failed to parse json body:"+err.Error(), 400)
+			return
+		}
+		for _, event := range self.jsonEvents(events) {
+			self.setRequestFields(event, r)
+		}
+		self.writeEvents(w, r, events, dryRun)
+		return
+	}
+	r.ParseForm()
+	dryRun = r.Form.Get("dry_run") == "true"
+	r.Form.Del("dry_run")
+	event := self.formEvent(r.Form)
+	self.setRequestFields(event, r)
+	if dryRun {
+		self.writeEvents(w, r, []Event{event}, true)
+		return
+	}
+	if _, _, err := self.SendEvent(event, self.eventSource(r)); err == ErrDuplicate {
+		w.Header().Set("X-Event-Id", event.String("event_id"))
+		w.Header().Set("X-Duplicate", "true")
+		w.WriteHeader(200)
+		fmt.Fprintf(w, "0 messages have been writen. Duplicate event.")
+		return
+	} else if err == ErrDropped {
+		w.Header().Set("X-Event-Id", event.String("event_id"))
+		w.Header().Set("X-Dropped", "true")
+		w.WriteHeader(200)
+		fmt.Fprintf(w, "0 messages have been writen. Event dropped.")
+		return
+	} else if err != nil {
+		self.writeError(w, err)
+		return
+	}
+	// done
+	w.Header().Set("X-Event-Id", event.String("event_id"))
 	w.WriteHeader(200)
 	fmt.Fprintf(w, "1 messages have been writen.")
 }
+
+// formEvent makes an event from the form values
+func (self *DefaultHandler) formEvent(form url.Values) Event {
+	if self.MultiValue == nil {
+		return EventFromForm(form)
+	}
+	return self.MultiValue.Event(form)
+}
+
+// jsonEvents keeps the json arrays of the events according to the multi
+// value policy, the same way as the repeated form parameters
+func (self *DefaultHandler) jsonEvents(events []Event) []Event {
+	policy := self.MultiValue
+	if policy == nil {
+		policy = &MultiValuePolicy{mode: MultiValueFirst}
+	}
+	for _, event := range events {
+		policy.Apply(event)
+	}
+	return events
+}
+
+// writeEvents sends the events to kafka, or only checks them in dry run
+// mode, and responds with the result of each event in json
+func (self *DefaultHandler) writeEvents(w http.ResponseWriter, r *http.Request, events []Event, dryRun bool) {
+	code, retry := 200, 0
+	results := make([]EventResult, len(events))
+	source := self.eventSource(r)
+	for i, event := range events {
+		var err error
+		if dryRun {
+			results[i].Record, err = self.CheckEvent(event)
+		} else {
+			results[i].Partition, results[i].Offset, err = self.SendEvent(event, source)
+		}
+		if err == ErrDuplicate {
+			results[i] = EventResult{Id: event.String("event_id"), Code: 200, Duplicate: true}
+			continue
+		} else if err == ErrDropped {
+			results[i] = EventResult{Id: event.String("event_id"), Code: 200, Dropped: true}
+			continue
+		} else if err != nil {
+			self.logger.WithFields(logrus.Fields{
+				"module": "Handler",
+			}).Errorln("Failed to write event", i, ":", err)
+			results[i] = EventResult{Id: event.String("event_id"), Code: ErrorCode(err), Error: err.Error(), Violations: ErrorViolations(err)}
+			if code == 200 {
+				code = results[i].Code
+			}
+			if ErrorRetryAfter(err) > retry {
+				retry = ErrorRetryAfter(err)
+			}
+			continue
+		}
+		results[i].Id = event.String("event_id")
+		results[i].Code = 200
+		results[i].Topic = event.String(TopicField)
+		if !dryRun {
+			MarkWritten(r)
+		}
+	}
+	if retry > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,136 @@
+package eventtracker
+
+import (
+	"bytes"
+	"errors"
+	"github.com/Shopify/sarama"
+	"github.com/lixin9311/logrus"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testProducer records the kafka messages, or fails them if fail is set
+type testProducer struct {
+	sync.Mutex
+	messages []*sarama.ProducerMessage
+	fail     bool
+}
+
+func (self *testProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	self.Lock()
+	defer self.Unlock()
+	if self.fail {
+		return 0, 0, errors.New("kafka is down")
+	}
+	self.messages = append(self.messages, msg)
+	return 0, int64(len(self.messages) - 1), nil
+}
+
+func (self *testProducer) Close() error {
+	return nil
+}
+
+// records decodes the avro records sent to kafka
+func (self *testProducer) records(t *testing.T, handler *DefaultHandler) []map[string]interface{} {
+	self.Lock()
+	defer self.Unlock()
+	var records []map[string]interface{}
+	for _, msg := range self.messages {
+		data, err := msg.Value.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, err := handler.avro.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := map[string]interface{}{}
+		for _, field := range record.Fields {
+			fields[field.Name] = field.Datum
+		}
+		records = append(records, fields)
+	}
+	return records
+}
+
+// newTestHandler makes a handler with the example schema, which sends to a
+// test producer
+func newTestHandler(t *testing.T) (*DefaultHandler, *testProducer) {
+	logger := logrus.New()
+	producer := &testProducer{}
+	kafka := &Kafka{producer: producer, topic: map[string]string{"default": "events", "click": "clicks"}, logger: logger}
+	avro := NewAvroInst(logger, avro_config{Schema: "../example_config/event.avsc"})
+	return NewDefaultHandler(logger, log.New(ioutil.Discard, "", 0), kafka, avro), producer
+}
+
+func TestSendEvent(t *testing.T) {
+	handler, producer := newTestHandler(t)
+	event := Event{"did": "a", "timestamp": "1456000000", "event_type": "open", "event_id": "e1", "channel": "ads"}
+	if _, _, err := handler.SendEvent(event, nil); err != nil {
+		t.Fatal(err)
+	}
+	records := producer.records(t, handler)
+	if len(records) != 1 {
+		t.Fatalf("%d records", len(records))
+	}
+	if records[0]["id"] != "e1" || records[0]["did"] != "a" || producer.messages[0].Topic != "events" {
+		t.Errorf("record = %v, topic = %s", records[0], producer.messages[0].Topic)
+	}
+	extension, _ := records[0]["extension"].(map[string]interface{})
+	if extension["channel"] != "ads" || extension["event_type"] != "open" {
+		t.Errorf("extension = %v", extension)
+	}
+	producer.fail = true
+	if _, _, err := handler.SendEvent(Event{"did": "a", "timestamp": "1456000000", "event_type": "open"}, nil); ErrorCode(err) != 500 {
+		t.Errorf("err = %v, want a spooled 500", err)
+	}
+}
+
+func TestSendEventDuplicates(t *testing.T) {
+	handler, producer := newTestHandler(t)
+	handler.Dedup = NewDeduplicator(logrus.New(), dedup_config{Window: "1h"})
+	handler.DeviceIds = NewDeviceIdNormalizer(logrus.New(), device_id_config{})
+	handler.Consent = NewConsentChecker(logrus.New(), consent_config{Policy: ConsentStrip})
+	tests := []struct {
+		name  string
+		event Event
+		err   error
+	}{
+		{name: "first event", event: Event{"did": "6D92078A-8246-C22D-59AD-1BA1A0D3AB56", "timestamp": "1456000000", "event_type": "open"}},
+		{name: "did in another case", event: Event{"did": "6d92078a-8246-c22d-59ad-1ba1a0d3ab56", "timestamp": "1456000000", "event_type": "open"}, err: ErrDuplicate},
+		{name: "stripped did", event: Event{"did": "a", "timestamp": "1456000000", "event_type": "open", "lat": "1"}},
+		{name: "other stripped did", event: Event{"did": "b", "timestamp": "1456000000", "event_type": "open", "lat": "1"}},
+	}
+	for _, test := range tests {
+		if _, _, err := handler.SendEvent(test.event, nil); err != test.err {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.err)
+		}
+	}
+	if len(producer.messages) != 3 {
+		t.Errorf("%d messages sent, want 3", len(producer.messages))
+	}
+}
+
+// the batch marks the signed request as written if any event is sent
+func TestWriteEventsMarkWritten(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	signer := NewSigner(logrus.New(), signing_config{Key: "secret"})
+	wrapped := signer.Wrap(handler.EventHandler)
+	body := `[{"did": "a", "timestamp": "1456000000", "event_type": "open"}, {"did": "b", "event_type": "open"}]`
+	for i, want := range []int{400, 401} {
+		r := httptest.NewRequest("POST", "/event?nonce=n1", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		params, _ := signer.requestParams(r)
+		r = httptest.NewRequest("POST", "/event?nonce=n1&sign="+signer.Sign(params), strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		wrapped(w, r)
+		if w.Code != want {
+			t.Errorf("request %d: code = %d, want %d: %s", i, w.Code, want, w.Body.String())
+		}
+	}
+}
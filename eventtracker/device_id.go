@@ -0,0 +1,194 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"regexp"
+	"strings"
+)
+
+const (
+	DidTypeIDFA      = "idfa"
+	DidTypeIDFV      = "idfv"
+	DidTypeGAID      = "gaid"
+	DidTypeAndroidId = "android_id"
+	DidTypeIMEI      = "imei"
+	// DidTypeUUID is an idfa, idfv or gaid whose platform is unknown
+	DidTypeUUID = "uuid"
+	// DidTypeUnknown is a did in none of the known formats
+	DidTypeUnknown = "unknown"
+)
+
+type device_id_config struct {
+	Enabled bool
+	// Zeroed is the policy of the zeroed ids sent when limit ad tracking is
+	// on, reject or flag
+	Zeroed string
+	// Unknown is the policy of the ids in none of the known formats, reject,
+	// flag or accept
+	Unknown string
+}
+
+var (
+	uuidPattern      = regexp.MustCompile(`^[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}$`)
+	androidIdPattern = regexp.MustCompile(`^[0-9a-fA-F]{16}$`)
+	imeiPattern      = regexp.MustCompile(`^[0-9]{15}$`)
+	// zeroedAndroidIds are returned by the emulators and some broken devices
+	zeroedAndroidIds = map[string]bool{"0000000000000000": true, "9774d56d682e549c": true}
+)
+
+// DeviceIdNormalizer detects the type of the did, normalizes its format and
+// checks the zeroed and unknown ids
+type DeviceIdNormalizer struct {
+	rejectZeroed  bool
+	rejectUnknown bool
+	flagUnknown   bool
+}
+
+// NewDeviceIdNormalizer makes a device id normalizer
+func NewDeviceIdNormalizer(w *logrus.Logger, conf device_id_config) *DeviceIdNormalizer {
+	self := &DeviceIdNormalizer{}
+	switch conf.Zeroed {
+	case "", "reject":
+		self.rejectZeroed = true
+	case "flag":
+	default:
+		w.WithFields(logrus.Fields{
+			"module": "device_id",
+		}).Fatalln("Unrecognized zeroed policy:", conf.Zeroed)
+	}
+	switch conf.Unknown {
+	case "", "flag":
+		self.flagUnknown = true
+	case "reject":
+		self.rejectUnknown = true
+	case "accept":
+	default:
+		w.WithFields(logrus.Fields{
+			"module": "device_id",
+		}).Fatalln("Unrecognized unknown policy:", conf.Unknown)
+	}
+	return self
+}
+
+// NormalizeDeviceId returns the normalized did and its type. If didType is
+// set the did must be in its format, otherwise the type is detected, uuids
+// are told apart by the platform hint, ios or android.
+func NormalizeDeviceId(did, didType, platform string) (string, string, bool) {
+	did = strings.TrimSpace(did)
+	did = strings.TrimSuffix(strings.TrimPrefix(did, "{"), "}")
+	switch {
+	case uuidPattern.MatchString(did):
+		hex := strings.Replace(did, "-", "", -1)
+		did = hex[0:8] + "-" + hex[8:12] + "-" + hex[12:16] + "-" + hex[16:20] + "-" + hex[20:32]
+		if didType == "" {
+			switch platform {
+			case "ios":
+				didType = DidTypeIDFA
+			case "android":
+				didType = DidTypeGAID
+			default:
+				didType = DidTypeUUID
+			}
+		}
+		switch didType {
+		case DidTypeIDFA, DidTypeIDFV:
+			return strings.ToUpper(did), didType, true
+		case DidTypeGAID, DidTypeUUID:
+			return strings.ToLower(did), didType, true
+		}
+	case androidIdPattern.MatchString(did):
+		if didType == "" || didType == DidTypeAndroidId {
+			return strings.ToLower(did), DidTypeAndroidId, true
+		}
+	default:
+		digits := strings.NewReplacer(" ", "", "-", "").Replace(did)
+		if imeiPattern.MatchString(digits) && luhn(digits) && (didType == "" || didType == DidTypeIMEI) {
+			return digits, DidTypeIMEI, true
+		}
+	}
+	return did, didType, false
+}
+
+// luhn checks the check digit of an imei
+func luhn(digits string) bool {
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if (len(digits)-i)%2 == 0 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// isZeroedDeviceId tells whether a normalized did is a placeholder
+func isZeroedDeviceId(did, didType string) bool {
+	if didType == DidTypeAndroidId {
+		return zeroedAndroidIds[did]
+	}
+	return strings.Trim(did, "0-") == ""
+}
+
+// platformHint guesses the platform of the event from the os declared by the
+// client or the raw user agent. The os parsed by the user agent parser is
+// not used, the enrichers run after the dids are normalized.
+func platformHint(event Event) string {
+	switch strings.ToLower(strings.TrimSpace(event.String("os"))) {
+	case "ios", "ipados":
+		return "ios"
+	case "android":
+		return "android"
+	}
+	ua := strings.ToLower(event.String("user_agent"))
+	switch {
+	case strings.Contains(ua, "android"):
+		return "android"
+	case strings.Contains(ua, "iphone"), strings.Contains(ua, "ipad"), strings.Contains(ua, "ipod"), strings.Contains(ua, "like mac os x"), strings.Contains(ua, "cfnetwork"):
+		return "ios"
+	}
+	return ""
+}
+
+// NormalizeEvent normalizes the did of the event and records its type in the
+// did_type field. Zeroed and unknown ids are rejected, or flagged in the
+// did_flag field. The events handled by the consent policy, whose opt_out
+// field is set, are only flagged, and the stripped dids are skipped.
+func (self *DeviceIdNormalizer) NormalizeEvent(event Event) error {
+	consent := event.String("opt_out") != ""
+	if consent && event.String("did") == "" {
+		return nil
+	}
+	didType := strings.ToLower(strings.TrimSpace(event.String("did_type")))
+	switch didType {
+	case "", DidTypeIDFA, DidTypeIDFV, DidTypeGAID, DidTypeAndroidId, DidTypeIMEI:
+	default:
+		return &HandlerError{Code: 400, Msg: "Unknown did_type: " + didType}
+	}
+	did, detected, ok := NormalizeDeviceId(event.String("did"), didType, platformHint(event))
+	if !ok {
+		if didType != "" {
+			return &HandlerError{Code: 400, Msg: "did is not a valid " + didType + ": " + event.String("did")}
+		}
+		if self.rejectUnknown && !consent {
+			return &HandlerError{Code: 400, Msg: "Unrecognized did: " + event.String("did")}
+		}
+		if self.flagUnknown || consent {
+			event["did_flag"] = "unknown"
+		}
+		event["did_type"] = DidTypeUnknown
+		return nil
+	}
+	if isZeroedDeviceId(did, detected) {
+		if self.rejectZeroed && !consent {
+			return &HandlerError{Code: 400, Msg: "Zeroed did: " + event.String("did")}
+		}
+		event["did_flag"] = "zeroed"
+	}
+	event["did"] = did
+	event["did_type"] = detected
+	return nil
+}
@@ -0,0 +1,170 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"testing"
+)
+
+func TestNormalizeDeviceId(t *testing.T) {
+	tests := []struct {
+		did      string
+		didType  string
+		platform string
+		want     string
+		wantType string
+		ok       bool
+	}{
+		{did: "6d92078a-8246-c22d-59ad-1ba1a0d3ab56", platform: "ios", want: "6D92078A-8246-C22D-59AD-1BA1A0D3AB56", wantType: DidTypeIDFA, ok: true},
+		{did: "6D92078A8246C22D59AD1BA1A0D3AB56", platform: "android", want: "6d92078a-8246-c22d-59ad-1ba1a0d3ab56", wantType: DidTypeGAID, ok: true},
+		{did: " {6D92078A-8246-C22D-59AD-1BA1A0D3AB56} ", want: "6d92078a-8246-c22d-59ad-1ba1a0d3ab56", wantType: DidTypeUUID, ok: true},
+		{did: "6d92078a-8246-c22d-59ad-1ba1a0d3ab56", didType: DidTypeIDFV, platform: "android", want: "6D92078A-8246-C22D-59AD-1BA1A0D3AB56", wantType: DidTypeIDFV, ok: true},
+		{did: "9774D56D682E549C", want: "9774d56d682e549c", wantType: DidTypeAndroidId, ok: true},
+		{did: "9774d56d682e549c", didType: DidTypeGAID, want: "9774d56d682e549c", wantType: DidTypeGAID},
+		{did: "49-015420-323751-8", want: "490154203237518", wantType: DidTypeIMEI, ok: true},
+		// wrong check digit
+		{did: "490154203237519", want: "490154203237519"},
+		{did: "490154203237518", didType: DidTypeIDFA, want: "490154203237518", wantType: DidTypeIDFA},
+		{did: "not a did", want: "not a did"},
+	}
+	for _, test := range tests {
+		did, didType, ok := NormalizeDeviceId(test.did, test.didType, test.platform)
+		if did != test.want || didType != test.wantType || ok != test.ok {
+			t.Errorf("NormalizeDeviceId(%q, %q, %q) = %q, %q, %v", test.did, test.didType, test.platform, did, didType, ok)
+		}
+	}
+}
+
+func TestLuhn(t *testing.T) {
+	tests := map[string]bool{
+		"490154203237518": true,
+		"356938035643809": true,
+		"490154203237519": false,
+		"000000000000000": true,
+	}
+	for digits, want := range tests {
+		if got := luhn(digits); got != want {
+			t.Errorf("luhn(%s) = %v, want %v", digits, got, want)
+		}
+	}
+}
+
+func TestIsZeroedDeviceId(t *testing.T) {
+	tests := []struct {
+		did     string
+		didType string
+		want    bool
+	}{
+		{"00000000-0000-0000-0000-000000000000", DidTypeIDFA, true},
+		{"00000000-0000-0000-0000-000000000000", DidTypeGAID, true},
+		{"000000000000000", DidTypeIMEI, true},
+		{"0000000000000000", DidTypeAndroidId, true},
+		{"9774d56d682e549c", DidTypeAndroidId, true},
+		{"6d92078a-8246-c22d-59ad-1ba1a0d3ab56", DidTypeGAID, false},
+		{"9774d56d682e549d", DidTypeAndroidId, false},
+	}
+	for _, test := range tests {
+		if got := isZeroedDeviceId(test.did, test.didType); got != test.want {
+			t.Errorf("isZeroedDeviceId(%s, %s) = %v, want %v", test.did, test.didType, got, test.want)
+		}
+	}
+}
+
+func TestPlatformHint(t *testing.T) {
+	tests := []struct {
+		event Event
+		want  string
+	}{
+		{Event{"os": "iOS"}, "ios"},
+		{Event{"os": "Android"}, "android"},
+		{Event{"user_agent": "Mozilla/5.0 (iPhone; CPU iPhone OS 10_3 like Mac OS X)"}, "ios"},
+		{Event{"user_agent": "MyApp/1.0 CFNetwork/808.3 Darwin/16.3.0"}, "ios"},
+		{Event{"user_agent": "Mozilla/5.0 (Linux; Android 7.0; Nexus 5 Build/NRD90M)"}, "android"},
+		// the declared os wins over the user agent
+		{Event{"os": "android", "user_agent": "Mozilla/5.0 (iPhone; CPU iPhone OS 10_3 like Mac OS X)"}, "android"},
+		{Event{"user_agent": "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_12_4)"}, ""},
+		{Event{"user_agent": "Mozilla/5.0 (Windows NT 10.0; Win64; x64)"}, ""},
+		{Event{}, ""},
+	}
+	for _, test := range tests {
+		if got := platformHint(test.event); got != test.want {
+			t.Errorf("platformHint(%v) = %q, want %q", test.event, got, test.want)
+		}
+	}
+}
+
+func TestDeviceIdNormalizeEvent(t *testing.T) {
+	normalizer := NewDeviceIdNormalizer(logrus.New(), device_id_config{Zeroed: "reject", Unknown: "flag"})
+	tests := []struct {
+		name  string
+		event Event
+		want  Event
+		fail  bool
+	}{
+		{
+			name:  "idfa by the user agent",
+			event: Event{"did": "6d92078a-8246-c22d-59ad-1ba1a0d3ab56", "user_agent": "Mozilla/5.0 (iPhone; CPU iPhone OS 10_3 like Mac OS X)"},
+			want:  Event{"did": "6D92078A-8246-C22D-59AD-1BA1A0D3AB56", "did_type": DidTypeIDFA},
+		},
+		{
+			name:  "declared did_type",
+			event: Event{"did": "6D92078A-8246-C22D-59AD-1BA1A0D3AB56", "did_type": " GAID "},
+			want:  Event{"did": "6d92078a-8246-c22d-59ad-1ba1a0d3ab56", "did_type": DidTypeGAID},
+		},
+		{
+			name:  "did not in the declared type",
+			event: Event{"did": "9774d56d682e549d", "did_type": "imei"},
+			fail:  true,
+		},
+		{
+			name:  "unsupported did_type",
+			event: Event{"did": "9774d56d682e549d", "did_type": "oaid"},
+			fail:  true,
+		},
+		{
+			name:  "unknown did is flagged",
+			event: Event{"did": "xyz"},
+			want:  Event{"did": "xyz", "did_type": DidTypeUnknown, "did_flag": "unknown"},
+		},
+		{
+			name:  "zeroed did is rejected",
+			event: Event{"did": "00000000-0000-0000-0000-000000000000"},
+			fail:  true,
+		},
+	}
+	for _, test := range tests {
+		err := normalizer.NormalizeEvent(test.event)
+		if (err != nil) != test.fail {
+			t.Errorf("%s: err = %v", test.name, err)
+			continue
+		}
+		if test.fail {
+			if ErrorCode(err) != 400 {
+				t.Errorf("%s: code = %d, want 400", test.name, ErrorCode(err))
+			}
+			continue
+		}
+		for k, v := range test.want {
+			if test.event[k] != v {
+				t.Errorf("%s: %s = %v, want %v", test.name, k, test.event[k], v)
+			}
+		}
+		if _, ok := test.event["did_flag"]; ok != (test.want["did_flag"] != nil) {
+			t.Errorf("%s: did_flag = %v", test.name, test.event["did_flag"])
+		}
+	}
+}
+
+// the user agent parser runs after the dids are normalized, the raw user
+// agent of the request is the platform hint
+func TestDeviceIdPlatformOfRequest(t *testing.T) {
+	handler, _ := newTestHandler(t)
+	handler.DeviceIds = NewDeviceIdNormalizer(logrus.New(), device_id_config{})
+	handler.Enrichers = append(handler.Enrichers, NewUserAgentParser(logrus.New(), useragent_config{Rules: "../example_config/ua_rules.json"}))
+	event := Event{"did": "6d92078a8246c22d59ad1ba1a0d3ab56", "timestamp": "1456000000", "event_type": "open", "user_agent": "Mozilla/5.0 (iPhone; CPU iPhone OS 10_3 like Mac OS X)"}
+	if _, err := handler.NewEventRecord(event); err != nil {
+		t.Fatal(err)
+	}
+	if event.String("did") != "6D92078A-8246-C22D-59AD-1BA1A0D3AB56" || event.String("did_type") != DidTypeIDFA || event.String("os") != "iOS" {
+		t.Errorf("event = %v", event)
+	}
+}
@@ -0,0 +1,21 @@
+package eventtracker
+
+// Enricher adds fields to an event before it is converted to an avro record
+type Enricher interface {
+	Enrich(event Event) error
+}
+
+// Reloader is an enricher whose data is loaded from files, Reload loads the
+// changed files again, or all of them if force is set
+type Reloader interface {
+	Reload(force bool)
+}
+
+// ResolvedIP returns the ip used to enrich an event, the server observed ip
+// if known, otherwise the ip field
+func (self Event) ResolvedIP() string {
+	if ip := self.String("observed_ip"); ip != "" {
+		return ip
+	}
+	return self.String("ip")
+}
@@ -0,0 +1,201 @@
+package eventtracker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+)
+
+var (
+	// TopLevelFields are the fields set directly on the avro record,
+	// all other fields of an event go to the extension map
+	TopLevelFields = []string{"did", "aid", "ip", "timestamp"}
+	// RequiredFields must be present in every event
+	RequiredFields = []string{"did", "timestamp", "event_type"}
+)
+
+// Event holds the fields of an incoming event before it is converted to an
+// avro record. Top level fields and extension fields share the same map.
+type Event map[string]interface{}
+
+// HandlerError is an error with the http status code reported to the client
+type HandlerError struct {
+	Code int
+	Msg  string
+	// Spooled is set when the event has been written to the backup file
+	Spooled bool
+	// Violations lists the failed validation rules
+	Violations []string
+	// RetryAfter is the number of seconds to wait when rate limited
+	RetryAfter int
+}
+
+func (self *HandlerError) Error() string {
+	return self.Msg
+}
+
+// ErrorViolations returns the failed validation rules of an error
+func ErrorViolations(err error) []string {
+	if herr, ok := err.(*HandlerError); ok {
+		return herr.Violations
+	}
+	return nil
+}
+
+// ErrorRetryAfter returns the seconds to wait of a rate limited error, 0 if
+// not rate limited
+func ErrorRetryAfter(err error) int {
+	if herr, ok := err.(*HandlerError); ok {
+		return herr.RetryAfter
+	}
+	return 0
+}
+
+// ErrorCode returns the http status code of an error, 500 if unknown
+func ErrorCode(err error) int {
+	if herr, ok := err.(*HandlerError); ok {
+		return herr.Code
+	}
+	return 500
+}
+
+// IsTopLevelField reports whether key is a top level field of the avro record
+func IsTopLevelField(key string) bool {
+	for _, v := range TopLevelFields {
+		if v == key {
+			return true
+		}
+	}
+	return false
+}
+
+// EventType returns the event_type of the event
+func (self Event) EventType() string {
+	return self.String("event_type")
+}
+
+// String returns the field as a string, empty if missing
+func (self Event) String(key string) string {
+	if v, ok := self[key].(string); ok {
+		return v
+	}
+	return ""
+}
+
+// CheckRequired checks the required fields of the event
+func (self Event) CheckRequired() error {
+	for _, k := range RequiredFields {
+		if _, ok := self[k]; !ok {
+			return &HandlerError{Code: 400, Msg: "Missing Required field: No " + k}
+		}
+	}
+	return nil
+}
+
+// EventFromForm makes an event from url values, only the first value of
+// each key is used
+func EventFromForm(form url.Values) Event {
+	event := Event{}
+	for k, v := range form {
+		if len(v) > 0 {
+			event[k] = v[0]
+		}
+	}
+	return event
+}
+
+// EventFromJSON makes an event from a decoded json object. Arrays of
+// scalars are kept as multi values, the multi value policy decides how they
+// are stored. Other values which are not strings are stored in their json
+// text form.
+func EventFromJSON(obj map[string]interface{}) (Event, error) {
+	event := Event{}
+	for k, v := range obj {
+		if v == nil {
+			continue
+		} else if value, ok := jsonScalar(v); ok {
+			event[k] = value
+		} else if values, ok := jsonScalars(v); ok {
+			event[k] = values
+		} else {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			event[k] = string(data)
+		}
+	}
+	return event, nil
+}
+
+// jsonScalar returns the string form of a json string, number or bool
+func jsonScalar(v interface{}) (string, bool) {
+	switch value := v.(type) {
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return fmt.Sprint(value), true
+	}
+	return "", false
+}
+
+// jsonScalars returns the multi value of a json array of scalars, null
+// elements are skipped
+func jsonScalars(v interface{}) ([]interface{}, bool) {
+	array, ok := v.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	values := make([]interface{}, 0, len(array))
+	for _, elem := range array {
+		if elem == nil {
+			continue
+		}
+		value, ok := jsonScalar(elem)
+		if !ok {
+			return nil, false
+		}
+		values = append(values, value)
+	}
+	return values, true
+}
+
+// DecodeJSONEvents reads a json body containing either one event object or
+// an array of event objects, nothing may follow it
+func DecodeJSONEvents(r io.Reader) ([]Event, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var body interface{}
+	if err := decoder.Decode(&body); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the body")
+	}
+	var objs []interface{}
+	switch value := body.(type) {
+	case map[string]interface{}:
+		objs = []interface{}{value}
+	case []interface{}:
+		objs = value
+	default:
+		return nil, errors.New("body is neither an object nor an array")
+	}
+	events := make([]Event, 0, len(objs))
+	for i, v := range objs {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("event %d is not an object", i)
+		}
+		event, err := EventFromJSON(obj)
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %s", i, err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
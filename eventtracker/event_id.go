@@ -0,0 +1,51 @@
+package eventtracker
+
+import (
+	"crypto/rand"
+	"time"
+)
+
+const (
+	// crockford is the base32 alphabet of ULID
+	crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	// MaxEventIdLength is the maximum length of a client event_id
+	MaxEventIdLength = 128
+)
+
+// NewEventId returns a new ULID, 48 bits of unix milliseconds followed by
+// 80 random bits in 26 characters of crockford base32. The ids sort by the
+// time they are generated.
+func NewEventId() string {
+	var data [16]byte
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	for i := 5; i >= 0; i-- {
+		data[i] = byte(ms)
+		ms >>= 8
+	}
+	if _, err := rand.Read(data[6:]); err != nil {
+		panic(err)
+	}
+	// 128 bits in 26 characters, the first character holds 3 bits
+	var id [26]byte
+	hi := uint64(data[0])<<56 | uint64(data[1])<<48 | uint64(data[2])<<40 | uint64(data[3])<<32 |
+		uint64(data[4])<<24 | uint64(data[5])<<16 | uint64(data[6])<<8 | uint64(data[7])
+	lo := uint64(data[8])<<56 | uint64(data[9])<<48 | uint64(data[10])<<40 | uint64(data[11])<<32 |
+		uint64(data[12])<<24 | uint64(data[13])<<16 | uint64(data[14])<<8 | uint64(data[15])
+	for i := 25; i >= 0; i-- {
+		id[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(id[:])
+}
+
+// Id returns the event_id of the event, a new id is assigned if the client
+// did not provide one
+func (self Event) Id() string {
+	if id := self.String("event_id"); id != "" {
+		return id
+	}
+	id := NewEventId()
+	self["event_id"] = id
+	return id
+}
@@ -0,0 +1,63 @@
+package eventtracker
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeJSONEvents(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []Event
+		fail bool
+	}{
+		{
+			name: "one object",
+			body: `{"did": "a", "timestamp": 1456000000, "event_type": "open"}`,
+			want: []Event{{"did": "a", "timestamp": "1456000000", "event_type": "open"}},
+		},
+		{
+			name: "array of objects",
+			body: `[{"did": "a"}, {"did": "b"}]`,
+			want: []Event{{"did": "a"}, {"did": "b"}},
+		},
+		{
+			name: "numbers are kept as written",
+			body: `{"price": 1.10, "big": 12345678901234567890, "exp": 1e3}`,
+			want: []Event{{"price": "1.10", "big": "12345678901234567890", "exp": "1e3"}},
+		},
+		{
+			name: "bools and nulls",
+			body: `{"paid": true, "lat": false, "coupon": null}`,
+			want: []Event{{"paid": "true", "lat": "false"}},
+		},
+		{
+			name: "arrays of scalars are multi values",
+			body: `{"tags": ["a", 1, true, null]}`,
+			want: []Event{{"tags": []interface{}{"a", "1", "true"}}},
+		},
+		{
+			name: "nested objects and arrays are json text",
+			body: `{"item": {"id": 1, "sku": "x"}, "matrix": [[1, 2]], "items": [{"id": 1}]}`,
+			want: []Event{{"item": `{"id":1,"sku":"x"}`, "matrix": `[[1,2]]`, "items": `[{"id":1}]`}},
+		},
+		{name: "empty array", body: `[]`, want: []Event{}},
+		{name: "malformed", body: `{"did": "a"`, fail: true},
+		{name: "empty body", body: ``, fail: true},
+		{name: "scalar body", body: `"did"`, fail: true},
+		{name: "array of scalars", body: `[{"did": "a"}, 1]`, fail: true},
+		{name: "trailing data", body: `{"did": "a"} {"did": "b"}`, fail: true},
+	}
+	for _, test := range tests {
+		events, err := DecodeJSONEvents(strings.NewReader(test.body))
+		if (err != nil) != test.fail {
+			t.Errorf("%s: err = %v", test.name, err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(events, test.want) {
+			t.Errorf("%s: events = %v, want %v", test.name, events, test.want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"github.com/oschwald/maxminddb-golang"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type geoip_config struct {
+	Enabled bool
+	// City_db and Asn_db are MaxMind format database files, e.g.
+	// GeoLite2-City.mmdb and GeoLite2-ASN.mmdb, either can be empty
+	City_db string
+	Asn_db  string
+	// Language of the region and city names, en by default
+	Language string
+	// Reload_interval is the interval to check the database files for
+	// changes, in go duration format
+	Reload_interval string
+}
+
+// geoCity is the record of the city database
+type geoCity struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		IsoCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+// geoASN is the record of the asn database
+type geoASN struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoDB is a database file which is reopened when it changes
+type geoDB struct {
+	sync.RWMutex
+	path    string
+	modTime time.Time
+	reader  *maxminddb.Reader
+}
+
+// reload opens the database again if the file has changed or force is set
+func (self *geoDB) reload(force bool) (bool, error) {
+	info, err := os.Stat(self.path)
+	if err != nil {
+		return false, err
+	}
+	if !force && info.ModTime().Equal(self.modTime) {
+		return false, nil
+	}
+	reader, err := maxminddb.Open(self.path)
+	if err != nil {
+		return false, err
+	}
+	self.Lock()
+	old := self.reader
+	self.reader = reader
+	self.modTime = info.ModTime()
+	self.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return true, nil
+}
+
+func (self *geoDB) lookup(ip net.IP, result interface{}) error {
+	self.RLock()
+	defer self.RUnlock()
+	return self.reader.Lookup(ip, result)
+}
+
+// privateNets are the private and shared address ranges, which are not in
+// the geoip databases
+var privateNets = parseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7")
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, v := range cidrs {
+		_, cidr, err := net.ParseCIDR(v)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, cidr)
+	}
+	return nets
+}
+
+// IsPublicIP reports whether the ip may be found in the geoip databases
+func IsPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return false
+	}
+	for _, cidr := range privateNets {
+		if cidr.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// GeoIP looks up the resolved ip of an event in local MaxMind databases and
+// sets geo_country, geo_region, geo_city, geo_asn and geo_as_org
+type GeoIP struct {
+	city     *geoDB
+	asn      *geoDB
+	language string
+	logger   *logrus.Logger
+}
+
+// NewGeoIP opens the databases and starts watching them for changes
+func NewGeoIP(w *logrus.Logger, conf geoip_config) *GeoIP {
+	self := &GeoIP{language: conf.Language, logger: w}
+	if self.language == "" {
+		self.language = "en"
+	}
+	if conf.City_db != "" {
+		self.city = &geoDB{path: conf.City_db}
+	}
+	if conf.Asn_db != "" {
+		self.asn = &geoDB{path: conf.Asn_db}
+	}
+	for _, db := range self.dbs() {
+		if _, err := db.reload(true); err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "geoip",
+			}).Fatalln("Failed to open geoip database:", err)
+		}
+	}
+	interval := time.Minute
+	if conf.Reload_interval != "" {
+		var err error
+		if interval, err = time.ParseDuration(conf.Reload_interval); err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "geoip",
+			}).Fatalln("Invalid geoip reload_interval:", err)
+		}
+	}
+	go func() {
+		for range time.Tick(interval) {
+			self.Reload(false)
+		}
+	}()
+	w.WithFields(logrus.Fields{
+		"module": "geoip",
+	}).Infoln("Init completed.")
+	return self
+}
+
+func (self *GeoIP) dbs() []*geoDB {
+	var dbs []*geoDB
+	if self.city != nil {
+		dbs = append(dbs, self.city)
+	}
+	if self.asn != nil {
+		dbs = append(dbs, self.asn)
+	}
+	return dbs
+}
+
+// Reload reopens the databases which have changed on disk, or all of them
+// if force is set
+func (self *GeoIP) Reload(force bool) {
+	for _, db := range self.dbs() {
+		reloaded, err := db.reload(force)
+		if err != nil {
+			self.logger.WithFields(logrus.Fields{
+				"module": "geoip",
+			}).Errorln("Failed to reload geoip database:", err)
+		} else if reloaded {
+			self.logger.WithFields(logrus.Fields{
+				"module": "geoip",
+			}).Infoln("Reloaded geoip database:", db.path)
+		}
+	}
+}
+
+// geoFields are the fields set by the geoip lookup
+var geoFields = []string{"geo_country", "geo_region", "geo_city", "geo_asn", "geo_as_org"}
+
+// Enrich sets the geo fields of the event, unknown and private ips are
+// skipped. The geo fields sent by the client are dropped.
+func (self *GeoIP) Enrich(event Event) error {
+	for _, k := range geoFields {
+		delete(event, k)
+	}
+	ip := net.ParseIP(event.ResolvedIP())
+	if ip == nil || !IsPublicIP(ip) {
+		return nil
+	}
+	if self.city != nil {
+		var record geoCity
+		if err := self.city.lookup(ip, &record); err != nil {
+			self.logger.WithFields(logrus.Fields{
+				"module": "geoip",
+			}).Debugln("Failed to lookup city:", err)
+		} else {
+			setNonEmpty(event, "geo_country", record.Country.IsoCode)
+			if len(record.Subdivisions) > 0 {
+				region := record.Subdivisions[0].Names[self.language]
+				if region == "" {
+					region = record.Subdivisions[0].IsoCode
+				}
+				setNonEmpty(event, "geo_region", region)
+			}
+			setNonEmpty(event, "geo_city", record.City.Names[self.language])
+		}
+	}
+	if self.asn != nil {
+		var record geoASN
+		if err := self.asn.lookup(ip, &record); err != nil {
+			self.logger.WithFields(logrus.Fields{
+				"module": "geoip",
+			}).Debugln("Failed to lookup asn:", err)
+		} else if record.Number != 0 {
+			event["geo_asn"] = strconv.FormatUint(uint64(record.Number), 10)
+			setNonEmpty(event, "geo_as_org", record.Organization)
+		}
+	}
+	return nil
+}
+
+func setNonEmpty(event Event, key, value string) {
+	if value != "" {
+		event[key] = value
+	}
+}
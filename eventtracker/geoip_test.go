@@ -0,0 +1,104 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"net"
+	"testing"
+)
+
+func newTestGeoIP(language string) *GeoIP {
+	return NewGeoIP(logrus.New(), geoip_config{
+		City_db:         "testdata/geoip-city.mmdb",
+		Asn_db:          "testdata/geoip-asn.mmdb",
+		Language:        language,
+		Reload_interval: "1h",
+	})
+}
+
+func TestGeoIPEnrich(t *testing.T) {
+	geoip := newTestGeoIP("")
+	tests := []struct {
+		ip   string
+		want map[string]string
+	}{
+		{"81.2.69.160", map[string]string{"geo_country": "GB", "geo_region": "England", "geo_city": "London", "geo_asn": "20712", "geo_as_org": "Andrews & Arnold Ltd"}},
+		{"175.16.199.1", map[string]string{"geo_country": "CN", "geo_region": "Jilin", "geo_city": "Changchun"}},
+		// the region falls back to the iso code
+		{"89.160.20.120", map[string]string{"geo_country": "SE", "geo_region": "E"}},
+		{"1.128.0.1", map[string]string{"geo_asn": "1221", "geo_as_org": "Telstra Pty Ltd"}},
+		// not in the databases
+		{"8.8.8.8", map[string]string{}},
+		// private and special addresses are not looked up
+		{"10.1.2.3", map[string]string{}},
+		{"192.168.1.1", map[string]string{}},
+		{"127.0.0.1", map[string]string{}},
+		{"::1", map[string]string{}},
+		{"not an ip", map[string]string{}},
+	}
+	for _, test := range tests {
+		// the fields sent by the client are dropped
+		event := Event{"ip": test.ip, "geo_country": "US", "geo_city": "Fake", "geo_asn": "1"}
+		if err := geoip.Enrich(event); err != nil {
+			t.Errorf("%s: unexpected error: %s", test.ip, err)
+			continue
+		}
+		for _, key := range geoFields {
+			if got := event.String(key); got != test.want[key] {
+				t.Errorf("%s: %s = %q, want %q", test.ip, key, got, test.want[key])
+			}
+		}
+	}
+}
+
+func TestGeoIPLanguage(t *testing.T) {
+	geoip := newTestGeoIP("zh-CN")
+	event := Event{"ip": "175.16.199.1"}
+	geoip.Enrich(event)
+	if event.String("geo_region") != "吉林" || event.String("geo_city") != "长春" {
+		t.Errorf("unexpected names: %v", event)
+	}
+	// the city name is missing in this language
+	event = Event{"ip": "81.2.69.160"}
+	geoip.Enrich(event)
+	if _, ok := event["geo_city"]; ok {
+		t.Errorf("unexpected geo_city: %v", event)
+	}
+	if event.String("geo_region") != "ENG" {
+		t.Errorf("geo_region = %q, want ENG", event.String("geo_region"))
+	}
+}
+
+func TestGeoIPObservedIP(t *testing.T) {
+	geoip := newTestGeoIP("")
+	// the server observed ip wins over the declared one
+	event := Event{"ip": "10.0.0.1", "observed_ip": "81.2.69.160"}
+	geoip.Enrich(event)
+	if event.String("geo_country") != "GB" {
+		t.Errorf("geo_country = %q, want GB", event.String("geo_country"))
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := map[string]bool{
+		"81.2.69.160":    true,
+		"2001:db8::1":    true,
+		"10.0.0.1":       false,
+		"172.16.0.1":     false,
+		"172.32.0.1":     true,
+		"192.168.0.1":    false,
+		"100.64.0.1":     false,
+		"127.0.0.1":      false,
+		"169.254.1.1":    false,
+		"0.0.0.0":        false,
+		"224.0.0.1":      false,
+		"::1":            false,
+		"fe80::1":        false,
+		"fd00::1":        false,
+		"::ffff:8.8.8.8": true,
+	}
+	for ip, want := range tests {
+		if got := IsPublicIP(net.ParseIP(ip)); got != want {
+			t.Errorf("IsPublicIP(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
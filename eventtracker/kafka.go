@@ -76,6 +76,13 @@ func (self *Kafka) SendByteMessage(msg []byte, event_type string) (partition int
 	return self.producer.SendMessage(message)
 }
 
+// SendByteMessageToTopic sends a byte slice message to the topic
+func (self *Kafka) SendByteMessageToTopic(msg []byte, topic string) (partition int32, offset int64, err error) {
+	message := &sarama.ProducerMessage{Topic: topic, Partition: self.partition}
+	message.Value = sarama.ByteEncoder(msg)
+	return self.producer.SendMessage(message)
+}
+
 // SendStringMessage sends a string message to kafka
 func (self *Kafka) SendStringMessage(msg string, event_type string) (partition int32, offset int64, err error) {
 	if _, ok := self.topic[event_type]; !ok {
@@ -0,0 +1,286 @@
+package eventtracker
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lixin9311/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type lookup_config struct {
+	Name string
+	// File is a csv file with a title line, or a json file of an object
+	// keyed by the key column or an array of objects
+	File string
+	// Key is the event field to look up
+	Key string
+	// Key_column is the key column of the file, the same as Key by default
+	Key_column string
+	// Columns are merged into the event, all columns by default
+	Columns []string
+	// Prefix is prepended to the merged field names
+	Prefix string
+	// Miss_field is set to "true" when the key is not found, empty to disable
+	Miss_field string
+	// Reload_interval is the interval to check the file for changes
+	Reload_interval string
+}
+
+// LookupTable merges the columns of a dictionary file into the events whose
+// key field matches a row. The dictionary is replaced atomically when the
+// file changes.
+type LookupTable struct {
+	sync.RWMutex
+	conf    lookup_config
+	modTime time.Time
+	rows    map[string]map[string]string
+	hits    uint64
+	misses  uint64
+	logger  *logrus.Logger
+}
+
+// NewLookupTable loads the dictionary and starts watching the file for changes
+func NewLookupTable(w *logrus.Logger, conf lookup_config) *LookupTable {
+	if conf.Key_column == "" {
+		conf.Key_column = conf.Key
+	}
+	if conf.Name == "" {
+		conf.Name = conf.Key
+	}
+	self := &LookupTable{conf: conf, logger: w}
+	if conf.Key == "" {
+		w.WithFields(logrus.Fields{
+			"module": "lookup",
+		}).Fatalln("Missing key of lookup table:", conf.Name)
+	}
+	if _, err := self.load(true); err != nil {
+		w.WithFields(logrus.Fields{
+			"module": "lookup",
+		}).Fatalln("Failed to load lookup table", conf.Name, ":", err)
+	}
+	interval := time.Minute
+	if conf.Reload_interval != "" {
+		var err error
+		if interval, err = time.ParseDuration(conf.Reload_interval); err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "lookup",
+			}).Fatalln("Invalid lookup reload_interval:", err)
+		}
+	}
+	go func() {
+		for range time.Tick(interval) {
+			self.Reload(false)
+		}
+	}()
+	w.WithFields(logrus.Fields{
+		"module": "lookup",
+	}).Infof("Lookup table %s loaded, %d rows.\n", conf.Name, len(self.rows))
+	return self
+}
+
+// Reload loads the file again if it has changed or force is set
+func (self *LookupTable) Reload(force bool) {
+	reloaded, err := self.load(force)
+	if err != nil {
+		self.logger.WithFields(logrus.Fields{
+			"module": "lookup",
+		}).Errorln("Failed to reload lookup table", self.conf.Name, ":", err)
+	} else if reloaded {
+		self.RLock()
+		rows := len(self.rows)
+		self.RUnlock()
+		self.logger.WithFields(logrus.Fields{
+			"module": "lookup",
+		}).Infof("Lookup table %s reloaded, %d rows.\n", self.conf.Name, rows)
+	}
+}
+
+func (self *LookupTable) load(force bool) (bool, error) {
+	info, err := os.Stat(self.conf.File)
+	if err != nil {
+		return false, err
+	}
+	if !force && info.ModTime().Equal(self.modTime) {
+		return false, nil
+	}
+	var rows map[string]map[string]string
+	if strings.ToLower(filepath.Ext(self.conf.File)) == ".json" {
+		rows, err = self.loadJSON()
+	} else {
+		rows, err = self.loadCSV()
+	}
+	if err != nil {
+		return false, err
+	}
+	self.Lock()
+	self.rows = rows
+	self.modTime = info.ModTime()
+	self.Unlock()
+	return true, nil
+}
+
+func (self *LookupTable) loadCSV() (map[string]map[string]string, error) {
+	file, err := os.Open(self.conf.File)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("Empty lookup file")
+	}
+	title := records[0]
+	key := -1
+	for i, v := range title {
+		if v == self.conf.Key_column {
+			key = i
+		}
+	}
+	if key < 0 {
+		return nil, errors.New("Key column not found: " + self.conf.Key_column)
+	}
+	rows := map[string]map[string]string{}
+	for _, record := range records[1:] {
+		row := map[string]string{}
+		for i, v := range title {
+			if i != key {
+				row[v] = record[i]
+			}
+		}
+		rows[record[key]] = row
+	}
+	return rows, nil
+}
+
+func (self *LookupTable) loadJSON() (map[string]map[string]string, error) {
+	data, err := ioutil.ReadFile(self.conf.File)
+	if err != nil {
+		return nil, err
+	}
+	// numbers are kept as they are written, e.g. numeric ids
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var body interface{}
+	if err = decoder.Decode(&body); err != nil {
+		return nil, err
+	}
+	rows := map[string]map[string]string{}
+	switch value := body.(type) {
+	case map[string]interface{}:
+		for k, v := range value {
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("Row is not an object: " + k)
+			}
+			rows[k] = lookupRow(obj, "")
+		}
+	case []interface{}:
+		for i, v := range value {
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Row %d is not an object", i)
+			}
+			key, ok := obj[self.conf.Key_column]
+			if !ok {
+				return nil, fmt.Errorf("Row %d has no key column", i)
+			}
+			value, ok := jsonScalar(key)
+			if !ok {
+				return nil, fmt.Errorf("Row %d has an invalid key", i)
+			}
+			rows[value] = lookupRow(obj, self.conf.Key_column)
+		}
+	default:
+		return nil, errors.New("Lookup file is neither an object nor an array")
+	}
+	return rows, nil
+}
+
+// lookupRow converts the values of a json row to strings, the values which
+// are not scalars are kept in their json text form
+func lookupRow(obj map[string]interface{}, key string) map[string]string {
+	row := map[string]string{}
+	for k, v := range obj {
+		if k == key || v == nil {
+			continue
+		}
+		if value, ok := jsonScalar(v); ok {
+			row[k] = value
+		} else if data, err := json.Marshal(v); err == nil {
+			row[k] = string(data)
+		}
+	}
+	return row
+}
+
+// Enrich merges the matched row into the event, fields already set are kept
+func (self *LookupTable) Enrich(event Event) error {
+	key := event.String(self.conf.Key)
+	if key == "" {
+		return nil
+	}
+	self.RLock()
+	row, ok := self.rows[key]
+	self.RUnlock()
+	if !ok {
+		atomic.AddUint64(&self.misses, 1)
+		if self.conf.Miss_field != "" {
+			event[self.conf.Miss_field] = "true"
+		}
+		return nil
+	}
+	atomic.AddUint64(&self.hits, 1)
+	if len(self.conf.Columns) == 0 {
+		for k, v := range row {
+			setDefault(event, self.conf.Prefix+k, v)
+		}
+		return nil
+	}
+	for _, k := range self.conf.Columns {
+		if v, ok := row[k]; ok {
+			setDefault(event, self.conf.Prefix+k, v)
+		}
+	}
+	return nil
+}
+
+// LookupStats is the counters of a lookup table
+type LookupStats struct {
+	Name   string `json:"name"`
+	Rows   int    `json:"rows"`
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// Stats returns the counters of the lookup table
+func (self *LookupTable) Stats() LookupStats {
+	self.RLock()
+	rows := len(self.rows)
+	self.RUnlock()
+	return LookupStats{Name: self.conf.Name, Rows: rows, Hits: atomic.LoadUint64(&self.hits), Misses: atomic.LoadUint64(&self.misses)}
+}
+
+// LookupStatsHandler reports the counters of the lookup tables in json
+func (self *DefaultHandler) LookupStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := []LookupStats{}
+	for _, enricher := range self.Enrichers {
+		if table, ok := enricher.(*LookupTable); ok {
+			stats = append(stats, table.Stats())
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,87 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeLookupFile(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "lookup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLookupTableEnrich(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		conf    lookup_config
+		event   Event
+		want    Event
+	}{
+		{
+			name:    "csv",
+			file:    "campaigns.csv",
+			content: "aid,campaign_id,advertiser\n12345678,c1,acme\n",
+			conf:    lookup_config{Key: "aid"},
+			event:   Event{"aid": "12345678"},
+			want:    Event{"aid": "12345678", "campaign_id": "c1", "advertiser": "acme"},
+		},
+		{
+			name:    "json object with numbers",
+			file:    "campaigns.json",
+			content: `{"12345678": {"campaign_id": 87654321, "budget": 1.5, "active": true, "tags": ["a"]}}`,
+			conf:    lookup_config{Key: "aid"},
+			event:   Event{"aid": "12345678"},
+			want:    Event{"aid": "12345678", "campaign_id": "87654321", "budget": "1.5", "active": "true", "tags": `["a"]`},
+		},
+		{
+			name:    "json array keyed by a numeric column",
+			file:    "campaigns.json",
+			content: `[{"id": 12345678, "campaign_id": "c1"}, {"id": 2, "campaign_id": "c2"}]`,
+			conf:    lookup_config{Key: "aid", Key_column: "id"},
+			event:   Event{"aid": "12345678"},
+			want:    Event{"aid": "12345678", "campaign_id": "c1"},
+		},
+		{
+			name:    "columns, prefix and fields already set",
+			file:    "campaigns.csv",
+			content: "aid,campaign_id,advertiser\n1,c1,acme\n",
+			conf:    lookup_config{Key: "aid", Columns: []string{"campaign_id", "advertiser"}, Prefix: "lk_"},
+			event:   Event{"aid": "1", "lk_advertiser": "client"},
+			want:    Event{"aid": "1", "lk_campaign_id": "c1", "lk_advertiser": "client"},
+		},
+		{
+			name:    "miss",
+			file:    "campaigns.csv",
+			content: "aid,campaign_id\n1,c1\n",
+			conf:    lookup_config{Key: "aid", Miss_field: "campaign_miss"},
+			event:   Event{"aid": "2"},
+			want:    Event{"aid": "2", "campaign_miss": "true"},
+		},
+	}
+	for _, test := range tests {
+		path := writeLookupFile(t, test.file, test.content)
+		defer os.RemoveAll(filepath.Dir(path))
+		test.conf.File = path
+		test.conf.Reload_interval = "1h"
+		table := NewLookupTable(logrus.New(), test.conf)
+		if err := table.Enrich(test.event); err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+		if !reflect.DeepEqual(test.event, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, test.event, test.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"net/url"
+	"strings"
+)
+
+const (
+	// MultiValueFirst keeps only the first value of a repeated parameter
+	MultiValueFirst = "first"
+	// MultiValueArray keeps all values as an array in the extension map
+	MultiValueArray = "array"
+	// MultiValueJoin joins all values with the separator
+	MultiValueJoin = "join"
+)
+
+type multi_value_config struct {
+	// Mode is first, array or join
+	Mode      string
+	Separator string
+	// Event_types overrides the mode of an event type, e.g. for legacy topics
+	Event_types map[string]string
+}
+
+// MultiValuePolicy decides how repeated form parameters and json arrays are
+// stored in the extension map
+type MultiValuePolicy struct {
+	mode       string
+	separator  string
+	eventTypes map[string]string
+}
+
+// NewMultiValuePolicy makes a multi value policy, the array mode requires
+// the extension values of the avro schema to accept arrays
+func NewMultiValuePolicy(w *logrus.Logger, conf multi_value_config, avro *Avro) *MultiValuePolicy {
+	self := &MultiValuePolicy{mode: conf.Mode, separator: conf.Separator, eventTypes: conf.Event_types}
+	if self.mode == "" {
+		self.mode = MultiValueFirst
+	}
+	if self.separator == "" {
+		self.separator = ","
+	}
+	modes := []string{self.mode}
+	for _, mode := range conf.Event_types {
+		modes = append(modes, mode)
+	}
+	for _, mode := range modes {
+		switch mode {
+		case MultiValueFirst, MultiValueJoin:
+		case MultiValueArray:
+			if !avro.ExtensionArrays() {
+				w.WithFields(logrus.Fields{
+					"module": "multi_value",
+				}).Fatalln("The extension values of the avro schema do not accept arrays.")
+			}
+		default:
+			w.WithFields(logrus.Fields{
+				"module": "multi_value",
+			}).Fatalln("Unrecognized multi value mode:", mode)
+		}
+	}
+	return self
+}
+
+// Mode returns the mode of an event type
+func (self *MultiValuePolicy) Mode(event_type string) string {
+	if mode, ok := self.eventTypes[event_type]; ok {
+		return mode
+	}
+	return self.mode
+}
+
+// Event makes an event from url values. Top level fields always use the
+// first value, repeated extension fields are kept according to the mode of
+// the event type.
+func (self *MultiValuePolicy) Event(form url.Values) Event {
+	event := EventFromForm(form)
+	for k, v := range form {
+		if len(v) > 1 {
+			event[k] = MultiValue(v)
+		}
+	}
+	self.Apply(event)
+	return event
+}
+
+// Apply keeps the multi values of an event, the repeated form parameters or
+// the json arrays, according to the mode of the event type. Top level fields
+// and event_type always use the first value.
+func (self *MultiValuePolicy) Apply(event Event) {
+	for k, v := range event {
+		if values, ok := v.([]interface{}); ok && (IsTopLevelField(k) || k == "event_type") {
+			setFirstValue(event, k, values)
+		}
+	}
+	mode := self.Mode(event.EventType())
+	for k, v := range event {
+		values, ok := v.([]interface{})
+		if !ok {
+			continue
+		}
+		switch mode {
+		case MultiValueArray:
+		case MultiValueJoin:
+			event[k] = strings.Join(MultiValueStrings(values), self.separator)
+		default:
+			setFirstValue(event, k, values)
+		}
+	}
+}
+
+func setFirstValue(event Event, key string, values []interface{}) {
+	if len(values) == 0 {
+		delete(event, key)
+	} else {
+		event[key] = values[0]
+	}
+}
+
+// MultiValue makes the multi value of a field, which is []interface{} of
+// strings as the avro arrays are encoded from []interface{}
+func MultiValue(values []string) []interface{} {
+	value := make([]interface{}, len(values))
+	for i := range values {
+		value[i] = values[i]
+	}
+	return value
+}
+
+// MultiValueStrings returns the strings of a multi value
+func MultiValueStrings(value []interface{}) []string {
+	values := make([]string, 0, len(value))
+	for _, v := range value {
+		if s, ok := v.(string); ok {
+			values = append(values, s)
+		}
+	}
+	return values
+}
@@ -0,0 +1,260 @@
+package eventtracker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/lixin9311/logrus"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// PIIHash replaces the value with the salted sha256 hash
+	PIIHash = "hash"
+	// PIITruncate keeps the network prefix of an ip
+	PIITruncate = "truncate"
+	// PIIRedact removes the value
+	PIIRedact = "redact"
+)
+
+type pii_config struct {
+	// Fields maps the event field to the policy, hash, truncate or redact
+	Fields map[string]string
+	// Salt_file is the json file of the keyed salts, required by hash
+	Salt_file string
+	// Ipv4_prefix and Ipv6_prefix are the prefix lengths kept by truncate
+	Ipv4_prefix int
+	Ipv6_prefix int
+	// Reload_interval is the interval to check the salt file for changes
+	Reload_interval string
+}
+
+// piiSalt is one salt of the salt file, a salt is used from its start time
+// until the start time of the next one
+type piiSalt struct {
+	Id   string    `json:"id"`
+	Salt string    `json:"salt"`
+	From time.Time `json:"from"`
+}
+
+// PIIProtector hashes, truncates or redacts the personal fields of events.
+// Hashes are keyed by the salt of the current rotation period and prefixed
+// with its id, so they can be joined within the period.
+type PIIProtector struct {
+	sync.RWMutex
+	fields  map[string]string
+	path    string
+	ipv4    net.IPMask
+	ipv6    net.IPMask
+	salts   []piiSalt
+	modTime time.Time
+	logger  *logrus.Logger
+}
+
+// NewPIIProtector makes a pii protector, the salts are loaded from the salt
+// file and the file is watched for changes
+func NewPIIProtector(w *logrus.Logger, conf pii_config) *PIIProtector {
+	self := &PIIProtector{fields: map[string]string{}, path: conf.Salt_file, logger: w}
+	hash := false
+	for field, policy := range conf.Fields {
+		switch policy {
+		case PIIHash:
+			hash = true
+		case PIITruncate, PIIRedact:
+		default:
+			w.WithFields(logrus.Fields{
+				"module": "pii",
+			}).Fatalf("Unknown pii policy %s of %s\n", policy, field)
+		}
+		self.fields[field] = policy
+	}
+	if conf.Ipv4_prefix <= 0 {
+		conf.Ipv4_prefix = 24
+	}
+	if conf.Ipv6_prefix <= 0 {
+		conf.Ipv6_prefix = 48
+	}
+	if conf.Ipv4_prefix > 32 || conf.Ipv6_prefix > 128 {
+		w.WithFields(logrus.Fields{
+			"module": "pii",
+		}).Fatalln("Invalid pii prefix length.")
+	}
+	self.ipv4 = net.CIDRMask(conf.Ipv4_prefix, 32)
+	self.ipv6 = net.CIDRMask(conf.Ipv6_prefix, 128)
+	if !hash {
+		return self
+	}
+	if self.path == "" {
+		w.WithFields(logrus.Fields{
+			"module": "pii",
+		}).Fatalln("Salt file is required by the hash policy.")
+	}
+	if _, err := self.load(true); err != nil {
+		w.WithFields(logrus.Fields{
+			"module": "pii",
+		}).Fatalln("Failed to load salt file:", err)
+	}
+	interval := time.Minute
+	if conf.Reload_interval != "" {
+		var err error
+		if interval, err = time.ParseDuration(conf.Reload_interval); err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "pii",
+			}).Fatalln("Invalid pii reload_interval:", err)
+		}
+	}
+	go func() {
+		for range time.Tick(interval) {
+			self.Reload(false)
+		}
+	}()
+	w.WithFields(logrus.Fields{
+		"module": "pii",
+	}).Infof("Init completed, %d salts loaded.\n", len(self.salts))
+	return self
+}
+
+// Reload loads the salt file again if it has changed or force is set
+func (self *PIIProtector) Reload(force bool) {
+	if self.path == "" {
+		return
+	}
+	reloaded, err := self.load(force)
+	if err != nil {
+		self.logger.WithFields(logrus.Fields{
+			"module": "pii",
+		}).Errorln("Failed to reload salt file:", err)
+	} else if reloaded {
+		self.logger.WithFields(logrus.Fields{
+			"module": "pii",
+		}).Infoln("Salt file reloaded.")
+	}
+}
+
+func (self *PIIProtector) load(force bool) (bool, error) {
+	info, err := os.Stat(self.path)
+	if err != nil {
+		return false, err
+	}
+	if !force && info.ModTime().Equal(self.modTime) {
+		return false, nil
+	}
+	data, err := ioutil.ReadFile(self.path)
+	if err != nil {
+		return false, err
+	}
+	var salts []piiSalt
+	if err = json.Unmarshal(data, &salts); err != nil {
+		return false, err
+	}
+	if len(salts) == 0 {
+		return false, errors.New("No salt in the salt file")
+	}
+	for _, salt := range salts {
+		if salt.Id == "" || salt.Salt == "" {
+			return false, errors.New("Salt without id or salt in the salt file")
+		}
+	}
+	sort.Sort(bySaltFrom(salts))
+	self.Lock()
+	self.salts = salts
+	self.modTime = info.ModTime()
+	self.Unlock()
+	return true, nil
+}
+
+type bySaltFrom []piiSalt
+
+func (self bySaltFrom) Len() int           { return len(self) }
+func (self bySaltFrom) Less(i, j int) bool { return self[i].From.Before(self[j].From) }
+func (self bySaltFrom) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// salt returns the salt of the rotation period of t
+func (self *PIIProtector) salt(t time.Time) (piiSalt, error) {
+	self.RLock()
+	defer self.RUnlock()
+	for i := len(self.salts) - 1; i >= 0; i-- {
+		if !self.salts[i].From.After(t) {
+			return self.salts[i], nil
+		}
+	}
+	return piiSalt{}, errors.New("No salt for the current period")
+}
+
+// Protect applies the policies to the fields of the event, to every value
+// of the multi values. Redacted top level fields are set to empty, the others
+// are removed.
+func (self *PIIProtector) Protect(event Event) error {
+	var salt piiSalt
+	for field, policy := range self.fields {
+		value, ok := event[field]
+		if !ok {
+			continue
+		}
+		var f func(string) string
+		switch policy {
+		case PIIHash:
+			if salt.Id == "" {
+				var err error
+				if salt, err = self.salt(time.Now()); err != nil {
+					return &HandlerError{Code: 500, Msg: err.Error()}
+				}
+			}
+			f = salt.hash
+		case PIITruncate:
+			f = self.truncate
+		case PIIRedact:
+			redact(event, field)
+			continue
+		}
+		// values of other types are removed rather than written in plaintext
+		switch v := value.(type) {
+		case string:
+			event[field] = f(v)
+		case []interface{}:
+			event[field] = MultiValue(mapStrings(MultiValueStrings(v), f))
+		default:
+			redact(event, field)
+		}
+	}
+	return nil
+}
+
+// redact sets a top level field to empty and removes the others
+func redact(event Event, field string) {
+	if IsTopLevelField(field) {
+		event[field] = ""
+	} else {
+		delete(event, field)
+	}
+}
+
+// hash returns the id of the salt and the hmac-sha256 of the value
+func (self piiSalt) hash(value string) string {
+	if value == "" {
+		return value
+	}
+	mac := hmac.New(sha256.New, []byte(self.Salt))
+	mac.Write([]byte(value))
+	return self.Id + ":" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// truncate keeps the network prefix of an ip, values which are not ips are
+// removed
+func (self *PIIProtector) truncate(value string) string {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(self.ipv4).String()
+	}
+	return ip.Mask(self.ipv6).String()
+}
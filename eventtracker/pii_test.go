@@ -0,0 +1,109 @@
+package eventtracker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/lixin9311/logrus"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testHash(salt, value string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newTestPIIProtector(t *testing.T, fields map[string]string) *PIIProtector {
+	file, err := ioutil.TempFile("", "salts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	past := time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339)
+	future := time.Now().Add(48 * time.Hour).UTC().Format(time.RFC3339)
+	file.WriteString(`[{"id": "s2", "salt": "current", "from": "` + past + `"}, {"id": "s3", "salt": "next", "from": "` + future + `"}, {"id": "s1", "salt": "old", "from": "2016-01-01T00:00:00Z"}]`)
+	return NewPIIProtector(logrus.New(), pii_config{Fields: fields, Salt_file: file.Name(), Reload_interval: "1h"})
+}
+
+func TestPIIProtect(t *testing.T) {
+	protector := newTestPIIProtector(t, map[string]string{
+		"did":         PIIHash,
+		"email":       PIIHash,
+		"ip":          PIITruncate,
+		"observed_ip": PIITruncate,
+		"aid":         PIIRedact,
+		"phone":       PIIRedact,
+	})
+	defer os.Remove(protector.path)
+	tests := []struct {
+		name  string
+		event Event
+		want  Event
+	}{
+		{
+			name:  "hash with the current salt",
+			event: Event{"did": "abc", "email": ""},
+			want:  Event{"did": "s2:" + testHash("current", "abc"), "email": ""},
+		},
+		{
+			name:  "hash every value of a multi value",
+			event: Event{"email": []interface{}{"a@example.com", "b@example.com"}},
+			want:  Event{"email": []interface{}{"s2:" + testHash("current", "a@example.com"), "s2:" + testHash("current", "b@example.com")}},
+		},
+		{
+			name:  "truncate ips",
+			event: Event{"ip": "81.2.69.160", "observed_ip": "2001:db8:1234:5678::1"},
+			want:  Event{"ip": "81.2.69.0", "observed_ip": "2001:db8:1234::"},
+		},
+		{
+			name:  "truncate removes what is not an ip",
+			event: Event{"ip": "unknown"},
+			want:  Event{"ip": ""},
+		},
+		{
+			name:  "redact",
+			event: Event{"aid": "1", "phone": []interface{}{"1", "2"}},
+			want:  Event{"aid": ""},
+		},
+		{
+			name:  "unknown types are removed",
+			event: Event{"did": 12345, "email": map[string]interface{}{"a": "b"}},
+			want:  Event{"did": ""},
+		},
+	}
+	for _, test := range tests {
+		if err := protector.Protect(test.event); err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+		if !reflect.DeepEqual(test.event, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, test.event, test.want)
+		}
+	}
+}
+
+func TestPIISaltRotation(t *testing.T) {
+	protector := newTestPIIProtector(t, map[string]string{"did": PIIHash})
+	defer os.Remove(protector.path)
+	tests := []struct {
+		t    time.Time
+		want string
+	}{
+		{time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC), "s1"},
+		{time.Now(), "s2"},
+		{time.Now().Add(72 * time.Hour), "s3"},
+	}
+	for _, test := range tests {
+		salt, err := protector.salt(test.t)
+		if err != nil || salt.Id != test.want {
+			t.Errorf("%s: got %s %v, want %s", test.t, salt.Id, err, test.want)
+		}
+	}
+	if _, err := protector.salt(time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Errorf("expected no salt before the first period")
+	}
+}
@@ -0,0 +1,415 @@
+package eventtracker
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/lixin9311/logrus"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// RateKeyIP limits by the client ip
+	RateKeyIP = "ip"
+	// RateKeyApiKey limits by the authenticated client
+	RateKeyApiKey = "api_key"
+	// RateKeyApp limits by the app of the authenticated client
+	RateKeyApp = "app"
+)
+
+type rate_rule_config struct {
+	// Name identifies the rule in the quota usage
+	Name string
+	// Endpoint limits the requests of an endpoint, e.g. /event, empty for
+	// every endpoint
+	Endpoint string
+	// Event_type limits the events of the type instead of the requests, from
+	// Endpoint if it is set, otherwise from every endpoint
+	Event_type string
+	// Key is ip, api_key or app
+	Key string
+	// Rate is the number of tokens added per second, 0 for no rate limit
+	Rate float64
+	// Burst is the size of the bucket
+	Burst int
+	// Daily_quota is the maximum per key per day (UTC), 0 for no quota
+	Daily_quota int64
+}
+
+type ratelimit_config struct {
+	Enabled bool
+	Rules   []rate_rule_config
+	// Quota_file persists the quota usage of the day, empty to keep it in
+	// memory only
+	Quota_file string
+	// Save_interval is the interval to save the quota usage
+	Save_interval string
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateRule struct {
+	rate_rule_config
+	buckets map[string]*tokenBucket
+}
+
+// quotaUsage is the quota usage of a day, by rule and key
+type quotaUsage struct {
+	Day   string                      `json:"day"`
+	Usage map[string]map[string]int64 `json:"usage"`
+}
+
+// RateLimiter limits the requests and the events with token buckets, and
+// counts the daily quotas
+type RateLimiter struct {
+	sync.Mutex
+	rules  []*rateRule
+	usage  quotaUsage
+	dirty  bool
+	file   string
+	logger *logrus.Logger
+}
+
+// NewRateLimiter makes a rate limiter, the quota usage of the day is loaded
+// from the file
+func NewRateLimiter(w *logrus.Logger, conf ratelimit_config) *RateLimiter {
+	self := &RateLimiter{file: conf.Quota_file, usage: quotaUsage{Day: quotaDay(time.Now()), Usage: map[string]map[string]int64{}}, logger: w}
+	names := map[string]bool{}
+	for i, rule_conf := range conf.Rules {
+		switch rule_conf.Key {
+		case RateKeyIP, RateKeyApiKey, RateKeyApp:
+		default:
+			w.WithFields(logrus.Fields{
+				"module": "ratelimit",
+			}).Fatalf("Unknown key %s of rate limit rule %d\n", rule_conf.Key, i)
+		}
+		if rule_conf.Name == "" {
+			rule_conf.Name = strconv.Itoa(i)
+		}
+		if names[rule_conf.Name] {
+			w.WithFields(logrus.Fields{
+				"module": "ratelimit",
+			}).Fatalln("Duplicate rate limit rule:", rule_conf.Name)
+		}
+		names[rule_conf.Name] = true
+		if rule_conf.Burst <= 0 {
+			rule_conf.Burst = int(math.Max(1, math.Ceil(rule_conf.Rate)))
+		}
+		self.rules = append(self.rules, &rateRule{rate_rule_config: rule_conf, buckets: map[string]*tokenBucket{}})
+	}
+	if self.file != "" {
+		if err := self.load(); err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "ratelimit",
+			}).Fatalln("Failed to load quota file:", err)
+		}
+	}
+	interval := 10 * time.Second
+	if conf.Save_interval != "" {
+		var err error
+		if interval, err = time.ParseDuration(conf.Save_interval); err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "ratelimit",
+			}).Fatalln("Invalid ratelimit save_interval:", err)
+		}
+	}
+	go func() {
+		for range time.Tick(interval) {
+			self.sweep(time.Now())
+			if err := self.Save(); err != nil {
+				w.WithFields(logrus.Fields{
+					"module": "ratelimit",
+				}).Errorln("Failed to save quota file:", err)
+			}
+		}
+	}()
+	w.WithFields(logrus.Fields{
+		"module": "ratelimit",
+	}).Infof("Init completed, %d rules.\n", len(self.rules))
+	return self
+}
+
+// quotaDay returns the UTC day of the quotas
+func quotaDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// rotate resets the quota usage when the day changes, the caller must hold
+// the lock
+func (self *RateLimiter) rotate(now time.Time) {
+	if day := quotaDay(now); day != self.usage.Day {
+		self.usage = quotaUsage{Day: day, Usage: map[string]map[string]int64{}}
+		self.dirty = true
+	}
+}
+
+// take takes a token of every rule for the keys, nothing is taken if any of
+// them is exhausted and the time to wait is returned
+func (self *RateLimiter) take(rules []*rateRule, keys map[string]string) error {
+	self.Lock()
+	defer self.Unlock()
+	now := time.Now()
+	self.rotate(now)
+	var wait time.Duration
+	var limited *rateRule
+	for _, rule := range rules {
+		key := keys[rule.Key]
+		if key == "" {
+			continue
+		}
+		if rule.Rate > 0 {
+			bucket := rule.bucket(key, now)
+			if bucket.tokens < 1 {
+				if d := time.Duration((1 - bucket.tokens) / rule.Rate * float64(time.Second)); d > wait {
+					wait, limited = d, rule
+				}
+			}
+		}
+		if rule.Daily_quota > 0 && self.usage.Usage[rule.Name][key] >= rule.Daily_quota {
+			midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+			if d := midnight.Sub(now); d > wait {
+				wait, limited = d, rule
+			}
+		}
+	}
+	if limited != nil {
+		return &HandlerError{Code: 429, Msg: "Rate limit exceeded: " + limited.Name, RetryAfter: int(math.Ceil(wait.Seconds()))}
+	}
+	for _, rule := range rules {
+		key := keys[rule.Key]
+		if key == "" {
+			continue
+		}
+		if rule.Rate > 0 {
+			rule.bucket(key, now).tokens--
+		}
+		if rule.Daily_quota > 0 {
+			if self.usage.Usage[rule.Name] == nil {
+				self.usage.Usage[rule.Name] = map[string]int64{}
+			}
+			self.usage.Usage[rule.Name][key]++
+			self.dirty = true
+		}
+	}
+	return nil
+}
+
+// bucket returns the refilled bucket of the key, the caller must hold the lock
+func (self *rateRule) bucket(key string, now time.Time) *tokenBucket {
+	bucket, ok := self.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(self.Burst), last: now}
+		self.buckets[key] = bucket
+		return bucket
+	}
+	bucket.tokens = math.Min(float64(self.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*self.Rate)
+	bucket.last = now
+	return bucket
+}
+
+// sweep removes the buckets which have been refilled, they are the same as
+// new ones
+func (self *RateLimiter) sweep(now time.Time) {
+	self.Lock()
+	defer self.Unlock()
+	for _, rule := range self.rules {
+		if rule.Rate <= 0 {
+			continue
+		}
+		full := time.Duration(float64(rule.Burst) / rule.Rate * float64(time.Second))
+		for key, bucket := range rule.buckets {
+			if now.Sub(bucket.last) > full {
+				delete(rule.buckets, key)
+			}
+		}
+	}
+}
+
+// requestKeys returns the keys of the authenticated client and the ip
+func requestKeys(ip string, client *Client) map[string]string {
+	keys := map[string]string{RateKeyIP: ip}
+	if client != nil {
+		keys[RateKeyApiKey] = client.Id
+		keys[RateKeyApp] = client.App
+	}
+	return keys
+}
+
+// AllowRequest takes a token of the request rules of the endpoint
+func (self *RateLimiter) AllowRequest(endpoint, ip string, client *Client) error {
+	var rules []*rateRule
+	for _, rule := range self.rules {
+		if rule.Event_type == "" && (rule.Endpoint == "" || rule.Endpoint == endpoint) {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	return self.take(rules, requestKeys(ip, client))
+}
+
+// EventSource is the request an event comes from, the events are counted by
+// the address and the authenticated client of the request, not by the fields
+// of the event which the client may forge
+type EventSource struct {
+	// Endpoint is the endpoint of the request, e.g. /event
+	Endpoint string
+	// Ip is the resolved ip of the request
+	Ip string
+	// Client is the authenticated client, nil if auth is not enabled
+	Client *Client
+	// Public is set for the endpoints opened by the users without an api
+	// key, e.g. /click, their events are not checked against the clients
+	Public bool
+}
+
+// eventSource returns the source of the events of a request
+func (self *DefaultHandler) eventSource(r *http.Request) *EventSource {
+	return &EventSource{Endpoint: r.URL.Path, Ip: self.ClientIP(r), Client: ClientFromRequest(r)}
+}
+
+// AllowEvent takes a token of the event rules of the event type and the
+// endpoint of the source
+func (self *RateLimiter) AllowEvent(eventType string, source *EventSource) error {
+	var rules []*rateRule
+	for _, rule := range self.rules {
+		if rule.Event_type != "" && rule.Event_type == eventType && (rule.Endpoint == "" || rule.Endpoint == source.Endpoint) {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	return self.take(rules, requestKeys(source.Ip, source.Client))
+}
+
+// Save writes the quota usage to the file if it has changed
+func (self *RateLimiter) Save() error {
+	if self.file == "" {
+		return nil
+	}
+	self.Lock()
+	if !self.dirty {
+		self.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(self.usage)
+	self.dirty = false
+	self.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := self.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, self.file)
+}
+
+// load reads the quota usage of today from the file
+func (self *RateLimiter) load() error {
+	data, err := ioutil.ReadFile(self.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var usage quotaUsage
+	if err = json.Unmarshal(data, &usage); err != nil {
+		return err
+	}
+	if usage.Day != quotaDay(time.Now()) {
+		return nil
+	}
+	if usage.Usage == nil {
+		return errors.New("Invalid quota file")
+	}
+	self.usage = usage
+	return nil
+}
+
+// QuotaReport is the quota usage of a rule
+type QuotaReport struct {
+	Rule  string           `json:"rule"`
+	Key   string           `json:"key"`
+	Quota int64            `json:"quota"`
+	Usage map[string]int64 `json:"usage"`
+}
+
+// Quotas returns the quota usage of today of the rules with a daily quota
+func (self *RateLimiter) Quotas() (string, []QuotaReport) {
+	self.Lock()
+	defer self.Unlock()
+	self.rotate(time.Now())
+	reports := []QuotaReport{}
+	for _, rule := range self.rules {
+		if rule.Daily_quota <= 0 {
+			continue
+		}
+		usage := map[string]int64{}
+		for k, v := range self.usage.Usage[rule.Name] {
+			usage[k] = v
+		}
+		reports = append(reports, QuotaReport{Rule: rule.Name, Key: rule.Key, Quota: rule.Daily_quota, Usage: usage})
+	}
+	return self.usage.Day, reports
+}
+
+// ResetQuota clears the usage of a key of a rule, or of every key if key is
+// empty
+func (self *RateLimiter) ResetQuota(rule, key string) {
+	self.Lock()
+	defer self.Unlock()
+	if key == "" {
+		delete(self.usage.Usage, rule)
+	} else if usage, ok := self.usage.Usage[rule]; ok {
+		delete(usage, key)
+	}
+	self.dirty = true
+}
+
+// RateLimit limits the requests of an endpoint, 429 is returned with the
+// seconds to wait in Retry-After
+func (self *DefaultHandler) RateLimit(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if self.RateLimiter != nil {
+			if err := self.RateLimiter.AllowRequest(endpoint, self.ClientIP(r), ClientFromRequest(r)); err != nil {
+				self.writeError(w, err)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// QuotaHandler reports the quota usage of today in json, DELETE with the rule
+// and optionally the key parameters resets the usage
+func (self *DefaultHandler) QuotaHandler(w http.ResponseWriter, r *http.Request) {
+	if self.RateLimiter == nil {
+		self.ErrorAndReturnCode(w, "Rate limit is not enabled.", 404)
+		return
+	}
+	if r.Method == "DELETE" {
+		rule := r.URL.Query().Get("rule")
+		if rule == "" {
+			self.ErrorAndReturnCode(w, "Missing rule.", 400)
+			return
+		}
+		self.RateLimiter.ResetQuota(rule, r.URL.Query().Get("key"))
+	} else if r.Method != "GET" {
+		self.ErrorAndReturnCode(w, "Method not allowed.", 405)
+		return
+	}
+	day, reports := self.RateLimiter.Quotas()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"day": day, "quotas": reports})
+}
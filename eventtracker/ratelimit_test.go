@@ -0,0 +1,94 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(logrus.New(), ratelimit_config{Rules: []rate_rule_config{
+		{Name: "event_per_ip", Endpoint: "/event", Key: RateKeyIP, Rate: 0.001, Burst: 2},
+		{Name: "order_per_app", Event_type: "order", Key: RateKeyApp, Daily_quota: 1},
+		{Name: "beacon_open_per_ip", Endpoint: "/beacon", Event_type: "open", Key: RateKeyIP, Daily_quota: 1},
+	}})
+	client := &Client{Id: "c1", App: "app1"}
+	tests := []struct {
+		name  string
+		allow func() error
+		code  int
+	}{
+		{name: "first request", allow: func() error { return limiter.AllowRequest("/event", "1.1.1.1", nil) }},
+		{name: "burst", allow: func() error { return limiter.AllowRequest("/event", "1.1.1.1", nil) }},
+		{name: "bucket exhausted", allow: func() error { return limiter.AllowRequest("/event", "1.1.1.1", nil) }, code: 429},
+		{name: "other ip", allow: func() error { return limiter.AllowRequest("/event", "2.2.2.2", nil) }},
+		{name: "other endpoint", allow: func() error { return limiter.AllowRequest("/beacon", "1.1.1.1", nil) }},
+		{name: "order within quota", allow: func() error {
+			return limiter.AllowEvent("order", &EventSource{Endpoint: "/event", Ip: "1.1.1.1", Client: client})
+		}},
+		{name: "order over quota", allow: func() error {
+			return limiter.AllowEvent("order", &EventSource{Endpoint: "/beacon", Ip: "2.2.2.2", Client: client})
+		}, code: 429},
+		{name: "other event type", allow: func() error {
+			return limiter.AllowEvent("click", &EventSource{Endpoint: "/event", Ip: "1.1.1.1", Client: client})
+		}},
+		{name: "no app key", allow: func() error { return limiter.AllowEvent("order", &EventSource{Endpoint: "/event", Ip: "1.1.1.1"}) }},
+		{name: "event type of the endpoint within quota", allow: func() error {
+			return limiter.AllowEvent("open", &EventSource{Endpoint: "/beacon", Ip: "1.1.1.1"})
+		}},
+		{name: "event type of the endpoint over quota", allow: func() error {
+			return limiter.AllowEvent("open", &EventSource{Endpoint: "/beacon", Ip: "1.1.1.1"})
+		}, code: 429},
+		{name: "event type of another endpoint", allow: func() error {
+			return limiter.AllowEvent("open", &EventSource{Endpoint: "/event", Ip: "1.1.1.1"})
+		}},
+	}
+	for _, test := range tests {
+		err := test.allow()
+		if code := 0; err != nil {
+			code = ErrorCode(err)
+			if code != test.code {
+				t.Errorf("%s: code = %d, want %d: %v", test.name, code, test.code, err)
+			} else if err.(*HandlerError).RetryAfter <= 0 {
+				t.Errorf("%s: no retry after", test.name)
+			}
+		} else if test.code != 0 {
+			t.Errorf("%s: allowed, want %d", test.name, test.code)
+		}
+	}
+}
+
+// the events are counted by the address of the request, not by the ip and
+// client_id sent in the body
+func TestRateLimitEventSource(t *testing.T) {
+	handler, producer := newTestHandler(t)
+	handler.RateLimiter = NewRateLimiter(logrus.New(), ratelimit_config{Rules: []rate_rule_config{
+		{Name: "open_per_ip", Event_type: "open", Key: RateKeyIP, Daily_quota: 1},
+		{Name: "open_per_client", Event_type: "open", Key: RateKeyApiKey, Daily_quota: 1},
+	}})
+	csv := "did,timestamp,event_type,ip,client_id\na,1456000000,open,1.1.1.1,c1\nb,1456000000,open,2.2.2.2,c2\n"
+	report, err := handler.ImportCSV(strings.NewReader(csv), ImportOptions{Ip: "3.3.3.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Accepted != 1 || report.Rejected != 1 || len(report.Errors) != 1 || report.Errors[0].Line != 3 {
+		t.Errorf("report = %+v", report)
+	}
+	for i, body := range []string{
+		`{"did": "c", "timestamp": "1456000000", "event_type": "open", "ip": "4.4.4.4", "client_id": "c3"}`,
+		`{"did": "d", "timestamp": "1456000000", "event_type": "open", "ip": "5.5.5.5", "client_id": "c4"}`,
+	} {
+		r := httptest.NewRequest("POST", "/event", strings.NewReader(body))
+		r.RemoteAddr = "6.6.6.6:1234"
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handler.EventHandler(w, r)
+		if want := []int{200, 429}[i]; w.Code != want {
+			t.Errorf("request %d: code = %d, want %d", i, w.Code, want)
+		}
+	}
+	if len(producer.messages) != 2 {
+		t.Errorf("%d messages sent, want 2", len(producer.messages))
+	}
+}
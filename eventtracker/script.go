@@ -0,0 +1,348 @@
+package eventtracker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lixin9311/logrus"
+	"github.com/robertkrimen/otto"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TopicField is set by the scripts to choose the kafka topic of an event,
+// it is not written to the record
+const TopicField = "_topic"
+
+// ErrDropped is returned when a script drops an event, it is not an error for
+// the client
+var ErrDropped = &HandlerError{Code: 200, Msg: "Event dropped."}
+
+var errScriptTimeout = errors.New("Script timeout")
+
+type script_config struct {
+	Name string
+	// File is a javascript file defining function process(event)
+	File string
+	// Event_types the script runs on, empty for all
+	Event_types []string
+	// Timeout of one run, in go duration format
+	Timeout string
+	// On_error is pass (keep the event as it was) or reject
+	On_error string
+	// Reload_interval is the interval to check the file for changes
+	Reload_interval string
+}
+
+// scriptWrapper calls the process function of the script with the event in
+// the layout of the avro record, and returns the modified event and the
+// result in json
+const scriptWrapper = `JSON.stringify((function(input) {
+	var event = JSON.parse(input);
+	var result = process(event);
+	return {event: event, result: result === undefined ? null : result};
+})(__event))`
+
+// Script runs a javascript function on every event. The function may modify
+// the event, drop it by returning false, or choose the kafka topic by
+// returning the topic name.
+type Script struct {
+	sync.Mutex
+	conf     script_config
+	types    map[string]bool
+	timeout  time.Duration
+	reject   bool
+	vm       *otto.Otto
+	wrapper  *otto.Script
+	modTime  time.Time
+	runs     uint64
+	errors   uint64
+	timeouts uint64
+	drops    uint64
+	routes   uint64
+	logger   *logrus.Logger
+}
+
+// NewScript loads the script and starts watching the file for changes
+func NewScript(w *logrus.Logger, conf script_config) *Script {
+	if conf.Name == "" {
+		conf.Name = conf.File
+	}
+	self := &Script{conf: conf, types: map[string]bool{}, timeout: 10 * time.Millisecond, logger: w}
+	for _, event_type := range conf.Event_types {
+		self.types[event_type] = true
+	}
+	var err error
+	if conf.Timeout != "" {
+		if self.timeout, err = time.ParseDuration(conf.Timeout); err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "script",
+			}).Fatalln("Invalid script timeout:", err)
+		}
+	}
+	switch conf.On_error {
+	case "", "pass":
+	case "reject":
+		self.reject = true
+	default:
+		w.WithFields(logrus.Fields{
+			"module": "script",
+		}).Fatalln("Unrecognized script on_error policy:", conf.On_error)
+	}
+	if _, err = self.load(true); err != nil {
+		w.WithFields(logrus.Fields{
+			"module": "script",
+		}).Fatalln("Failed to load script", conf.Name, ":", err)
+	}
+	interval := time.Minute
+	if conf.Reload_interval != "" {
+		if interval, err = time.ParseDuration(conf.Reload_interval); err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "script",
+			}).Fatalln("Invalid script reload_interval:", err)
+		}
+	}
+	go func() {
+		for range time.Tick(interval) {
+			self.Reload(false)
+		}
+	}()
+	w.WithFields(logrus.Fields{
+		"module": "script",
+	}).Infoln("Script loaded:", conf.Name)
+	return self
+}
+
+// Reload loads the file again if it has changed or force is set, the old
+// script is kept if the new one fails to compile
+func (self *Script) Reload(force bool) {
+	reloaded, err := self.load(force)
+	if err != nil {
+		self.logger.WithFields(logrus.Fields{
+			"module": "script",
+		}).Errorln("Failed to reload script", self.conf.Name, ":", err)
+	} else if reloaded {
+		self.logger.WithFields(logrus.Fields{
+			"module": "script",
+		}).Infoln("Script reloaded:", self.conf.Name)
+	}
+}
+
+func (self *Script) load(force bool) (bool, error) {
+	info, err := os.Stat(self.conf.File)
+	if err != nil {
+		return false, err
+	}
+	if !force && info.ModTime().Equal(self.modTime) {
+		return false, nil
+	}
+	src, err := ioutil.ReadFile(self.conf.File)
+	if err != nil {
+		return false, err
+	}
+	vm := otto.New()
+	compiled, err := vm.Compile(self.conf.File, string(src))
+	if err != nil {
+		return false, err
+	}
+	if _, err = vm.Run(compiled); err != nil {
+		return false, err
+	}
+	if process, err := vm.Get("process"); err != nil || !process.IsFunction() {
+		return false, errors.New("function process(event) is not defined")
+	}
+	wrapper, err := vm.Compile("", scriptWrapper)
+	if err != nil {
+		return false, err
+	}
+	self.Lock()
+	self.vm = vm
+	self.wrapper = wrapper
+	self.modTime = info.ModTime()
+	self.Unlock()
+	return true, nil
+}
+
+// Enrich runs the script on the event
+func (self *Script) Enrich(event Event) error {
+	if len(self.types) != 0 && !self.types[event.EventType()] {
+		return nil
+	}
+	atomic.AddUint64(&self.runs, 1)
+	result, err := self.run(event)
+	if err != nil {
+		atomic.AddUint64(&self.errors, 1)
+		if err == errScriptTimeout {
+			atomic.AddUint64(&self.timeouts, 1)
+		}
+		self.logger.WithFields(logrus.Fields{
+			"module": "script",
+		}).Warnln("Script", self.conf.Name, "failed:", err)
+		if self.reject {
+			return &HandlerError{Code: 400, Msg: "Script " + self.conf.Name + " failed:" + err.Error()}
+		}
+		return nil
+	}
+	switch value := result.(type) {
+	case nil:
+	case bool:
+		if !value {
+			atomic.AddUint64(&self.drops, 1)
+			return ErrDropped
+		}
+	case string:
+		if value != "" {
+			atomic.AddUint64(&self.routes, 1)
+			event[TopicField] = value
+		}
+	}
+	return nil
+}
+
+// run calls the process function with a copy of the vm, the event is only
+// modified if the script succeeds. Copying the vm is most of the cost of a
+// run (see BenchmarkScriptEnrich), but it keeps the global state of the
+// script from leaking between events, lets the events run concurrently, and
+// a vm stopped in the middle by the timeout is simply thrown away.
+func (self *Script) run(event Event) (result interface{}, err error) {
+	input, err := json.Marshal(scriptEvent(event))
+	if err != nil {
+		return nil, err
+	}
+	self.Lock()
+	vm := self.vm.Copy()
+	wrapper := self.wrapper
+	self.Unlock()
+	vm.Interrupt = make(chan func(), 1)
+	timer := time.AfterFunc(self.timeout, func() {
+		vm.Interrupt <- func() {
+			panic(errScriptTimeout)
+		}
+	})
+	defer timer.Stop()
+	defer func() {
+		if caught := recover(); caught != nil {
+			if caught == errScriptTimeout {
+				result, err = nil, errScriptTimeout
+				return
+			}
+			panic(caught)
+		}
+	}()
+	if err = vm.Set("__event", string(input)); err != nil {
+		return nil, err
+	}
+	value, err := vm.Run(wrapper)
+	if err != nil {
+		return nil, err
+	}
+	var output struct {
+		Event  map[string]interface{} `json:"event"`
+		Result interface{}            `json:"result"`
+	}
+	decoder := json.NewDecoder(strings.NewReader(value.String()))
+	decoder.UseNumber()
+	if err = decoder.Decode(&output); err != nil {
+		return nil, err
+	}
+	if output.Event == nil {
+		return nil, errors.New("event is not an object")
+	}
+	switch output.Result.(type) {
+	case nil, bool, string:
+	default:
+		return nil, fmt.Errorf("invalid result %v, expecting false or a topic", output.Result)
+	}
+	for k := range event {
+		if k != TopicField {
+			delete(event, k)
+		}
+	}
+	for k, v := range output.Event {
+		if k != "extension" {
+			setScriptValue(event, k, v)
+			continue
+		}
+		extension, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for k, v := range extension {
+			setScriptValue(event, k, v)
+		}
+	}
+	return output.Result, nil
+}
+
+// scriptEvent returns the event in the layout of the avro record, the
+// top-level fields and the extension map
+func scriptEvent(event Event) map[string]interface{} {
+	obj := map[string]interface{}{}
+	extension := map[string]interface{}{}
+	for k, v := range event {
+		if k == TopicField {
+			continue
+		} else if k == "event_id" || IsTopLevelField(k) {
+			obj[k] = v
+		} else {
+			extension[k] = v
+		}
+	}
+	obj["extension"] = extension
+	return obj
+}
+
+// setScriptValue sets a value returned by a script, arrays of scalars are
+// kept as multi values and the other non-string values are stored in their
+// json text form, the same way as the json events
+func setScriptValue(event Event, key string, value interface{}) {
+	if value == nil {
+		return
+	} else if v, ok := jsonScalar(value); ok {
+		event[key] = v
+	} else if values, ok := jsonScalars(value); ok {
+		event[key] = values
+	} else {
+		data, _ := json.Marshal(value)
+		event[key] = string(data)
+	}
+}
+
+// ScriptStats is the counters of a script
+type ScriptStats struct {
+	Name     string `json:"name"`
+	Runs     uint64 `json:"runs"`
+	Errors   uint64 `json:"errors"`
+	Timeouts uint64 `json:"timeouts"`
+	Drops    uint64 `json:"drops"`
+	Routes   uint64 `json:"routes"`
+}
+
+// Stats returns the counters of the script
+func (self *Script) Stats() ScriptStats {
+	return ScriptStats{
+		Name:     self.conf.Name,
+		Runs:     atomic.LoadUint64(&self.runs),
+		Errors:   atomic.LoadUint64(&self.errors),
+		Timeouts: atomic.LoadUint64(&self.timeouts),
+		Drops:    atomic.LoadUint64(&self.drops),
+		Routes:   atomic.LoadUint64(&self.routes),
+	}
+}
+
+// ScriptStatsHandler reports the counters of the scripts in json
+func (self *DefaultHandler) ScriptStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := []ScriptStats{}
+	for _, enricher := range self.Enrichers {
+		if script, ok := enricher.(*Script); ok {
+			stats = append(stats, script.Stats())
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,199 @@
+package eventtracker
+
+import (
+	"encoding/json"
+	"github.com/lixin9311/logrus"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSetScriptValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  interface{}
+	}{
+		{`"a"`, "a"},
+		{`12345678`, "12345678"},
+		{`1.5`, "1.5"},
+		{`true`, "true"},
+		{`["a", 1, false, null]`, []interface{}{"a", "1", "false"}},
+		{`[{"a": 1}]`, `[{"a":1}]`},
+		{`{"a": "b"}`, `{"a":"b"}`},
+	}
+	for _, test := range tests {
+		decoder := json.NewDecoder(strings.NewReader(test.value))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			t.Fatal(err)
+		}
+		event := Event{}
+		setScriptValue(event, "k", value)
+		if !reflect.DeepEqual(event["k"], test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.value, event["k"], test.want)
+		}
+	}
+	event := Event{}
+	setScriptValue(event, "k", nil)
+	if _, ok := event["k"]; ok {
+		t.Errorf("null should not be set")
+	}
+}
+
+// newTestScript writes the source to a file and loads it
+func newTestScript(t testing.TB, src string, conf script_config) *Script {
+	file, err := ioutil.TempFile("", "script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(src)
+	file.Close()
+	conf.File = file.Name()
+	script := NewScript(logrus.New(), conf)
+	os.Remove(file.Name())
+	return script
+}
+
+func TestScriptEnrich(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		conf  script_config
+		event Event
+		want  Event
+		err   error
+		code  int
+	}{
+		{
+			name:  "modify the event",
+			src:   `function process(event) { event.did = event.did.toUpperCase(); event.extension.channel = "ads"; delete event.extension.test; }`,
+			event: Event{"did": "abc", "event_type": "open", "test": "1"},
+			want:  Event{"did": "ABC", "event_type": "open", "channel": "ads"},
+		},
+		{
+			name:  "drop the event",
+			src:   `function process(event) { return event.extension.test !== "true"; }`,
+			event: Event{"did": "abc", "test": "true"},
+			err:   ErrDropped,
+		},
+		{
+			name:  "keep the event",
+			src:   `function process(event) { return true; }`,
+			event: Event{"did": "abc"},
+			want:  Event{"did": "abc"},
+		},
+		{
+			name:  "route the event",
+			src:   `function process(event) { return "large-orders"; }`,
+			event: Event{"did": "abc"},
+			want:  Event{"did": "abc", TopicField: "large-orders"},
+		},
+		{
+			name:  "other event types are skipped",
+			src:   `function process(event) { return false; }`,
+			conf:  script_config{Event_types: []string{"order"}},
+			event: Event{"did": "abc", "event_type": "open"},
+			want:  Event{"did": "abc", "event_type": "open"},
+		},
+		{
+			name:  "timeout passes the event",
+			src:   `function process(event) { event.did = "changed"; while (true) {} }`,
+			event: Event{"did": "abc"},
+			want:  Event{"did": "abc"},
+		},
+		{
+			name:  "timeout rejects the event",
+			src:   `function process(event) { while (true) {} }`,
+			conf:  script_config{On_error: "reject"},
+			event: Event{"did": "abc"},
+			code:  400,
+		},
+		{
+			name:  "error passes the event",
+			src:   `function process(event) { event.did = "changed"; throw new Error("failed"); }`,
+			event: Event{"did": "abc"},
+			want:  Event{"did": "abc"},
+		},
+		{
+			name:  "error rejects the event",
+			src:   `function process(event) { throw new Error("failed"); }`,
+			conf:  script_config{On_error: "reject"},
+			event: Event{"did": "abc"},
+			code:  400,
+		},
+		{
+			name:  "invalid result passes the event",
+			src:   `function process(event) { event.did = "changed"; return 42; }`,
+			event: Event{"did": "abc"},
+			want:  Event{"did": "abc"},
+		},
+		{
+			name:  "invalid result rejects the event",
+			src:   `function process(event) { return {topic: "a"}; }`,
+			conf:  script_config{On_error: "reject"},
+			event: Event{"did": "abc"},
+			code:  400,
+		},
+	}
+	for _, test := range tests {
+		test.conf.Timeout = "50ms"
+		script := newTestScript(t, test.src, test.conf)
+		err := script.Enrich(test.event)
+		if test.code != 0 {
+			if ErrorCode(err) != test.code {
+				t.Errorf("%s: err = %v, want code %d", test.name, err, test.code)
+			}
+			continue
+		}
+		if err != test.err {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(test.event, test.want) {
+			t.Errorf("%s: event = %v, want %v", test.name, test.event, test.want)
+		}
+	}
+}
+
+func TestScriptTimeout(t *testing.T) {
+	script := newTestScript(t, `function process(event) { while (true) {} }`, script_config{Timeout: "10ms"})
+	if _, err := script.run(Event{"did": "abc"}); err != errScriptTimeout {
+		t.Errorf("err = %v, want %v", err, errScriptTimeout)
+	}
+	script.Enrich(Event{"did": "abc"})
+	if stats := script.Stats(); stats.Runs != 1 || stats.Errors != 1 || stats.Timeouts != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+// the global state of a script does not leak into the next event
+func TestScriptIsolation(t *testing.T) {
+	script := newTestScript(t, `var count = 0; function process(event) { count++; event.extension.count = count; }`, script_config{})
+	for i := 0; i < 2; i++ {
+		event := Event{"did": "abc"}
+		if err := script.Enrich(event); err != nil {
+			t.Fatal(err)
+		}
+		if event.String("count") != "1" {
+			t.Errorf("count = %v, want 1", event["count"])
+		}
+	}
+}
+
+func BenchmarkScriptEnrich(b *testing.B) {
+	src, err := ioutil.ReadFile("../example_config/process.js")
+	if err != nil {
+		b.Fatal(err)
+	}
+	script := newTestScript(b, string(src), script_config{Timeout: "1s"})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		event := Event{"did": "abc", "timestamp": "1456000000", "event_type": "order", "amount": "100", "idfa": "6d92078a-8246-c22d-59ad-1ba1a0d3ab56"}
+		if err := script.Enrich(event); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
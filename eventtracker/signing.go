@@ -0,0 +1,395 @@
+package eventtracker
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/lixin9311/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// SignHMACSHA256 signs the canonical string with hmac-sha256
+	SignHMACSHA256 = "hmac-sha256"
+	// SignMD5 is the legacy scheme, the md5 of the canonical string followed
+	// by key=<secret>
+	SignMD5 = "md5"
+	// maxSignedBody is the maximum size of a signed request body
+	maxSignedBody = 10 * 1024 * 1024
+)
+
+type signing_config struct {
+	// Algorithm is hmac-sha256 or md5
+	Algorithm string
+	// Key is the shared secret
+	Key string
+	// Params are signed in this order, empty to sign every parameter but the
+	// signature sorted by name. A request body which is not a form is signed
+	// as the body_sha256 parameter.
+	Params []string
+	// Separator joins the key=value pairs, & by default for hmac-sha256 and
+	// nothing for md5 as the legacy partners do
+	Separator string
+	// Signature_param is the parameter of the signature, sign by default
+	Signature_param string
+	// Timestamp_param is checked against Max_skew, ts by default
+	Timestamp_param string
+	// Max_skew is the accepted difference between the timestamp and the
+	// server time, in go duration format, empty to skip the check. The
+	// timestamp must be in Params if they are set.
+	Max_skew string
+	// Nonce_param is the parameter of the nonce, nonce by default. Requests
+	// without a nonce use their signature as the nonce, and so do all the
+	// requests if the nonce is not in Params.
+	Nonce_param string
+	// Nonce_ttl is how long a nonce is remembered, twice Max_skew by default
+	Nonce_ttl string
+	// Nonce_cache_size is the maximum number of remembered nonces
+	Nonce_cache_size int
+	// Endpoints are the endpoints checked by the signer, empty for every
+	// endpoint it wraps by default
+	Endpoints []string
+}
+
+// Signer checks the signature of the requests and rejects the replayed ones
+type Signer struct {
+	algorithm string
+	key       []byte
+	params    []string
+	separator string
+	sigParam  string
+	tsParam   string
+	nonce     string
+	maxSkew   time.Duration
+	nonces    *nonceCache
+	endpoints map[string]bool
+	logger    *logrus.Logger
+}
+
+// NewSigner makes a signer
+func NewSigner(w *logrus.Logger, conf signing_config) *Signer {
+	self := &Signer{algorithm: conf.Algorithm, key: []byte(conf.Key), params: conf.Params, separator: conf.Separator, sigParam: conf.Signature_param, tsParam: conf.Timestamp_param, nonce: conf.Nonce_param, endpoints: map[string]bool{}, logger: w}
+	for _, endpoint := range conf.Endpoints {
+		self.endpoints[endpoint] = true
+	}
+	switch conf.Algorithm {
+	case "":
+		self.algorithm = SignHMACSHA256
+	case SignHMACSHA256, SignMD5:
+	default:
+		w.WithFields(logrus.Fields{
+			"module": "signing",
+		}).Fatalln("Unrecognized signing algorithm:", conf.Algorithm)
+	}
+	if conf.Key == "" {
+		w.WithFields(logrus.Fields{
+			"module": "signing",
+		}).Fatalln("Missing signing key.")
+	}
+	if self.separator == "" && self.algorithm == SignHMACSHA256 {
+		self.separator = "&"
+	}
+	if self.sigParam == "" {
+		self.sigParam = "sign"
+	}
+	if self.tsParam == "" {
+		self.tsParam = "ts"
+	}
+	if self.nonce == "" {
+		self.nonce = "nonce"
+	}
+	var err error
+	if conf.Max_skew != "" {
+		if self.maxSkew, err = time.ParseDuration(conf.Max_skew); err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "signing",
+			}).Fatalln("Invalid signing max_skew:", err)
+		}
+		// an unsigned timestamp can be replaced by the replayer
+		if !self.covers(self.tsParam) {
+			w.WithFields(logrus.Fields{
+				"module": "signing",
+			}).Fatalln("The signing timestamp param is not in params:", self.tsParam)
+		}
+	}
+	ttl := 2 * self.maxSkew
+	if conf.Nonce_ttl != "" {
+		if ttl, err = time.ParseDuration(conf.Nonce_ttl); err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "signing",
+			}).Fatalln("Invalid signing nonce_ttl:", err)
+		}
+	}
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	size := conf.Nonce_cache_size
+	if size <= 0 {
+		size = 1000000
+	}
+	self.nonces = newNonceCache(ttl, size)
+	return self
+}
+
+// Signs tells whether the requests of the endpoint are checked
+func (self *Signer) Signs(endpoint string) bool {
+	return len(self.endpoints) == 0 || self.endpoints[endpoint]
+}
+
+// covers tells whether the parameter is in the canonical string
+func (self *Signer) covers(name string) bool {
+	if len(self.params) == 0 {
+		return true
+	}
+	for _, param := range self.params {
+		if param == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Lists tells whether the endpoint is in the configured endpoints
+func (self *Signer) Lists(endpoint string) bool {
+	return self.endpoints[endpoint]
+}
+
+// Canonical returns the signed string of the parameters
+func (self *Signer) Canonical(params url.Values) string {
+	names := self.params
+	if len(names) == 0 {
+		for name := range params {
+			if name != self.sigParam {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		pairs = append(pairs, name+"="+strings.Join(params[name], ","))
+	}
+	if self.algorithm == SignMD5 {
+		pairs = append(pairs, "key="+string(self.key))
+	}
+	return strings.Join(pairs, self.separator)
+}
+
+// Sign returns the hex signature of the parameters
+func (self *Signer) Sign(params url.Values) string {
+	canonical := self.Canonical(params)
+	if self.algorithm == SignMD5 {
+		sum := md5.Sum([]byte(canonical))
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, self.key)
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature, the timestamp and the nonce of the
+// parameters. The nonce is remembered and returned, so it can be released if
+// the request fails.
+func (self *Signer) Verify(params url.Values) (string, error) {
+	signature := params.Get(self.sigParam)
+	if self.algorithm == SignMD5 {
+		// legacy partners append extra fields after a comma
+		signature = strings.Split(signature, ",")[0]
+	}
+	if signature == "" {
+		return "", &HandlerError{Code: 400, Msg: "Missing Required field: No " + self.sigParam}
+	}
+	expected := self.Sign(params)
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(signature)), []byte(expected)) != 1 {
+		return "", &HandlerError{Code: 401, Msg: "Invalid signature."}
+	}
+	now := time.Now()
+	if self.maxSkew > 0 {
+		t, err := ParseTimestamp(params.Get(self.tsParam))
+		if err != nil {
+			return "", &HandlerError{Code: 401, Msg: "Invalid signature timestamp: " + err.Error()}
+		}
+		if skew := now.Sub(t); skew > self.maxSkew || -skew > self.maxSkew {
+			return "", &HandlerError{Code: 401, Msg: "Signature timestamp out of window."}
+		}
+	}
+	// a nonce which is not signed could be changed by the replayer
+	var nonce string
+	if self.covers(self.nonce) {
+		nonce = params.Get(self.nonce)
+	}
+	if nonce == "" {
+		nonce = "sign:" + expected
+	}
+	if !self.nonces.Add(nonce, now) {
+		return "", &HandlerError{Code: 401, Msg: "Replayed request."}
+	}
+	return nonce, nil
+}
+
+// Release forgets a nonce, so the request can be retried
+func (self *Signer) Release(nonce string) {
+	self.nonces.Remove(nonce)
+}
+
+// writtenContextKey holds the write marker of a signed request
+const writtenContextKey contextKey = 1
+
+// writeMarker is set when a signed request has written an event
+type writeMarker struct {
+	written int32
+}
+
+// MarkWritten records that the request has written an event. A signed
+// request which failed in part, e.g. a batch, keeps its nonce, since a
+// replay would write the same events again.
+func MarkWritten(r *http.Request) {
+	if marker, ok := r.Context().Value(writtenContextKey).(*writeMarker); ok {
+		atomic.StoreInt32(&marker.written, 1)
+	}
+}
+
+// Wrap checks the signature of the requests of a handler, the signature and
+// the nonce are removed from the parameters afterwards. The nonce is
+// released if the handler fails without writing any event, so the client can
+// retry the request.
+func (self *Signer) Wrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var nonce string
+		params, err := self.requestParams(r)
+		if err == nil {
+			nonce, err = self.Verify(params)
+		}
+		if err != nil {
+			self.logger.WithFields(logrus.Fields{
+				"module": "signing",
+			}).Warnln("Rejected request from", r.RemoteAddr, ":", err)
+			http.Error(w, err.Error(), ErrorCode(err))
+			return
+		}
+		for _, name := range []string{self.sigParam, self.nonce} {
+			r.Form.Del(name)
+			if r.PostForm != nil {
+				r.PostForm.Del(name)
+			}
+		}
+		query := r.URL.Query()
+		query.Del(self.sigParam)
+		query.Del(self.nonce)
+		r.URL.RawQuery = query.Encode()
+		marker := &writeMarker{}
+		recorder := &statusRecorder{ResponseWriter: w, status: 200}
+		handler(recorder, r.WithContext(context.WithValue(r.Context(), writtenContextKey, marker)))
+		if recorder.status >= 400 && atomic.LoadInt32(&marker.written) == 0 {
+			self.Release(nonce)
+		}
+	}
+}
+
+// statusRecorder records the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (self *statusRecorder) WriteHeader(code int) {
+	self.status = code
+	self.ResponseWriter.WriteHeader(code)
+}
+
+// Flush flushes the streamed responses
+func (self *statusRecorder) Flush() {
+	if flusher, ok := self.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// requestParams returns the query and form parameters of the request, and
+// the sha256 of the body if it is not a form
+func (self *Signer) requestParams(r *http.Request) (url.Values, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, &HandlerError{Code: 400, Msg: "Failed to parse form:" + err.Error()}
+	}
+	params := url.Values{}
+	for k, v := range r.Form {
+		params[k] = v
+	}
+	if r.Body == nil || strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return params, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, &HandlerError{Code: 400, Msg: "Failed to read body:" + err.Error()}
+	}
+	if len(body) > maxSignedBody {
+		return nil, &HandlerError{Code: 413, Msg: "Signed body is too large."}
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if len(body) != 0 {
+		sum := sha256.Sum256(body)
+		params.Set("body_sha256", hex.EncodeToString(sum[:]))
+	}
+	return params, nil
+}
+
+type nonceEntry struct {
+	nonce string
+	seen  time.Time
+}
+
+// nonceCache remembers the nonces for ttl, the oldest ones are evicted when
+// it is full
+type nonceCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	max     int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newNonceCache(ttl time.Duration, max int) *nonceCache {
+	return &nonceCache{ttl: ttl, max: max, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+// Add remembers the nonce, false is returned if it has been seen
+func (self *nonceCache) Add(nonce string, now time.Time) bool {
+	self.Lock()
+	defer self.Unlock()
+	for oldest := self.order.Front(); oldest != nil; oldest = self.order.Front() {
+		entry := oldest.Value.(*nonceEntry)
+		if now.Sub(entry.seen) < self.ttl && self.order.Len() < self.max {
+			break
+		}
+		self.order.Remove(oldest)
+		delete(self.entries, entry.nonce)
+	}
+	if _, ok := self.entries[nonce]; ok {
+		return false
+	}
+	self.entries[nonce] = self.order.PushBack(&nonceEntry{nonce: nonce, seen: now})
+	return true
+}
+
+// Remove forgets the nonce
+func (self *nonceCache) Remove(nonce string) {
+	self.Lock()
+	defer self.Unlock()
+	if elem, ok := self.entries[nonce]; ok {
+		self.order.Remove(elem)
+		delete(self.entries, nonce)
+	}
+}
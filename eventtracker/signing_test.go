@@ -0,0 +1,167 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func signedParams(signer *Signer, params url.Values) url.Values {
+	params.Set("sign", signer.Sign(params))
+	return params
+}
+
+func TestSignerVerify(t *testing.T) {
+	signer := NewSigner(logrus.New(), signing_config{Key: "secret", Max_skew: "5m"})
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	replayed := signedParams(signer, url.Values{"did": {"a"}, "ts": {now}, "nonce": {"n0"}})
+	signer.Verify(replayed)
+	tests := []struct {
+		name   string
+		params url.Values
+		code   int
+	}{
+		{name: "valid", params: signedParams(signer, url.Values{"did": {"a"}, "ts": {now}, "nonce": {"n1"}})},
+		{name: "missing signature", params: url.Values{"did": {"a"}, "ts": {now}}, code: 400},
+		{name: "invalid signature", params: url.Values{"did": {"a"}, "ts": {now}, "sign": {"00"}}, code: 401},
+		{name: "tampered", params: func() url.Values {
+			params := signedParams(signer, url.Values{"did": {"a"}, "ts": {now}, "nonce": {"n2"}})
+			params.Set("did", "b")
+			return params
+		}(), code: 401},
+		{name: "timestamp out of window", params: signedParams(signer, url.Values{"did": {"a"}, "ts": {old}, "nonce": {"n3"}}), code: 401},
+		{name: "replayed", params: replayed, code: 401},
+	}
+	for _, test := range tests {
+		_, err := signer.Verify(test.params)
+		if code := 0; err != nil {
+			code = ErrorCode(err)
+			if code != test.code {
+				t.Errorf("%s: code = %d, want %d: %v", test.name, code, test.code, err)
+			}
+		} else if test.code != 0 {
+			t.Errorf("%s: accepted, want %d", test.name, test.code)
+		}
+	}
+}
+
+func TestSignerMD5(t *testing.T) {
+	signer := NewSigner(logrus.New(), signing_config{Algorithm: SignMD5, Key: "k", Params: []string{"b", "a"}})
+	params := url.Values{"a": {"1"}, "b": {"2"}, "c": {"3"}}
+	if canonical := signer.Canonical(params); canonical != "b=2a=1key=k" {
+		t.Errorf("canonical = %q", canonical)
+	}
+	// legacy partners append extra fields after a comma
+	params.Set("sign", signer.Sign(params)+",extra")
+	if _, err := signer.Verify(params); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSignerWrapRetry(t *testing.T) {
+	signer := NewSigner(logrus.New(), signing_config{Key: "secret"})
+	status := 500
+	handler := signer.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		if r.Form.Get("sign") != "" || r.URL.Query().Get("nonce") != "" {
+			t.Error("the signature is not removed")
+		}
+		w.WriteHeader(status)
+	})
+	query := signedParams(signer, url.Values{"did": {"a"}, "nonce": {"n1"}}).Encode()
+	tests := []struct {
+		name   string
+		status int
+		want   int
+	}{
+		{name: "failed request", status: 500, want: 500},
+		{name: "retry of the failed request", status: 200, want: 200},
+		{name: "replay of the written request", status: 200, want: 401},
+	}
+	for _, test := range tests {
+		status = test.status
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/event?"+query, nil))
+		if w.Code != test.want {
+			t.Errorf("%s: code = %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+}
+
+// the nonce outside of the configured params is not signed, the replayed
+// request can not escape with a new one
+func TestSignerUnsignedNonce(t *testing.T) {
+	signer := NewSigner(logrus.New(), signing_config{Algorithm: SignMD5, Key: "k", Params: []string{"idfa", "point", "ts"}, Nonce_ttl: "24h"})
+	params := signedParams(signer, url.Values{"idfa": {"a"}, "point": {"10"}, "ts": {"1456000000"}})
+	if _, err := signer.Verify(params); err != nil {
+		t.Fatal(err)
+	}
+	for _, nonce := range []string{"", "r1", "r2"} {
+		replayed := url.Values{}
+		for k, v := range params {
+			replayed[k] = v
+		}
+		if nonce != "" {
+			replayed.Set("nonce", nonce)
+		}
+		if _, err := signer.Verify(replayed); ErrorCode(err) != 401 {
+			t.Errorf("replay with nonce %q: err = %v, want 401", nonce, err)
+		}
+	}
+	// the nonce is used if it is signed
+	signer = NewSigner(logrus.New(), signing_config{Key: "k", Params: []string{"did", "nonce"}})
+	for _, nonce := range []string{"n1", "n2"} {
+		if _, err := signer.Verify(signedParams(signer, url.Values{"did": {"a"}, "nonce": {nonce}})); err != nil {
+			t.Errorf("nonce %s: %v", nonce, err)
+		}
+	}
+}
+
+// a failed batch which has written some events keeps its nonce
+func TestSignerWrapPartialWrite(t *testing.T) {
+	signer := NewSigner(logrus.New(), signing_config{Key: "secret"})
+	written := true
+	handler := signer.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		if written {
+			MarkWritten(r)
+		}
+		w.WriteHeader(400)
+	})
+	tests := []struct {
+		name    string
+		nonce   string
+		written bool
+		want    int
+	}{
+		{name: "partly written batch", nonce: "n1", written: true, want: 400},
+		{name: "replay of the partly written batch", nonce: "n1", want: 401},
+		{name: "failed batch", nonce: "n2", want: 400},
+		{name: "retry of the failed batch", nonce: "n2", want: 400},
+	}
+	for _, test := range tests {
+		written = test.written
+		query := signedParams(signer, url.Values{"did": {"a"}, "nonce": {test.nonce}}).Encode()
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/event?"+query, nil))
+		if w.Code != test.want {
+			t.Errorf("%s: code = %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+}
+
+func TestSignerSigns(t *testing.T) {
+	if !NewSigner(logrus.New(), signing_config{Key: "k"}).Signs("/click") {
+		t.Error("every endpoint is signed by default")
+	}
+	signer := NewSigner(logrus.New(), signing_config{Key: "k", Endpoints: []string{"/event"}})
+	if !signer.Signs("/event") || signer.Signs("/click") {
+		t.Error("only the configured endpoints are signed")
+	}
+	if signer.Lists("/click") || !NewSigner(logrus.New(), signing_config{Key: "k", Endpoints: []string{"/click"}}).Lists("/click") {
+		t.Error("/click is only signed if listed")
+	}
+}
@@ -0,0 +1,136 @@
+package eventtracker
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/lixin9311/logrus"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// StreamLineResult reports a failed line of the stream api
+type StreamLineResult struct {
+	Line  int    `json:"line"`
+	Id    string `json:"id,omitempty"`
+	Code  int    `json:"code"`
+	Error string `json:"error"`
+}
+
+// StreamProgress reports the progress of the stream api
+type StreamProgress struct {
+	Lines      int `json:"lines"`
+	Accepted   int `json:"accepted"`
+	Rejected   int `json:"rejected"`
+	Duplicates int `json:"duplicates"`
+	Dropped    int `json:"dropped"`
+}
+
+// StreamSummary is the last message of the stream api
+type StreamSummary struct {
+	StreamProgress
+	Truncated bool   `json:"truncated"`
+	Error     string `json:"error,omitempty"`
+}
+
+// StreamHandler reads newline delimited json events from the body and
+// sends them to kafka one by one. The body may be gzip compressed. Line
+// errors and progress are streamed back as json lines, the last line is
+// the summary, which is also set in the http trailers.
+func (self *DefaultHandler) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	remote := self.ClientIP(r)
+	self.logger.WithFields(logrus.Fields{
+		"module": "Handler",
+	}).Debugln("Incomming event stream from:", remote, "With Header:", RedactHeader(r.Header))
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" || r.Header.Get("Content-Type") == "application/gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			self.ErrorAndReturnCode(w, "Failed to open gzip body:"+err.Error(), 400)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	maxLines := self.MaxStreamLines
+	if tmp := r.URL.Query().Get("max_lines"); tmp != "" {
+		if n, err := strconv.Atoi(tmp); err == nil && n > 0 && n < maxLines {
+			maxLines = n
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Trailer", "X-Lines, X-Accepted, X-Rejected, X-Duplicates, X-Dropped")
+	w.WriteHeader(200)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	// the line numbers count the blank lines too, so they match the file of
+	// the client
+	summary := StreamSummary{}
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), self.MaxStreamLineSize)
+	for scanner.Scan() {
+		if summary.Lines >= maxLines {
+			summary.Truncated = true
+			summary.Error = "Line limit exceeded:" + strconv.Itoa(maxLines)
+			break
+		}
+		summary.Lines++
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			if id, err := self.sendStreamLine(line, r); err == ErrDuplicate {
+				summary.Duplicates++
+			} else if err == ErrDropped {
+				summary.Dropped++
+			} else if err != nil {
+				summary.Rejected++
+				encoder.Encode(StreamLineResult{Line: summary.Lines, Id: id, Code: ErrorCode(err), Error: err.Error()})
+				flush()
+			} else {
+				summary.Accepted++
+			}
+		}
+		if self.StreamProgressInterval > 0 && summary.Lines%self.StreamProgressInterval == 0 {
+			encoder.Encode(summary.StreamProgress)
+			flush()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		summary.Truncated = true
+		summary.Error = "Failed to read body:" + err.Error()
+	}
+	self.logger.WithFields(logrus.Fields{
+		"module": "Handler",
+	}).Debugf("Event stream done, lines=%d\taccepted=%d\trejected=%d\tduplicates=%d\tdropped=%d\n", summary.Lines, summary.Accepted, summary.Rejected, summary.Duplicates, summary.Dropped)
+	encoder.Encode(summary)
+	w.Header().Set("X-Lines", strconv.Itoa(summary.Lines))
+	w.Header().Set("X-Accepted", strconv.Itoa(summary.Accepted))
+	w.Header().Set("X-Rejected", strconv.Itoa(summary.Rejected))
+	w.Header().Set("X-Duplicates", strconv.Itoa(summary.Duplicates))
+	w.Header().Set("X-Dropped", strconv.Itoa(summary.Dropped))
+}
+
+// sendStreamLine decodes one line of the stream api and sends it to kafka,
+// the event_id is returned if the line has been decoded
+func (self *DefaultHandler) sendStreamLine(line string, r *http.Request) (string, error) {
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	obj := map[string]interface{}{}
+	if err := decoder.Decode(&obj); err != nil {
+		return "", &HandlerError{Code: 400, Msg: "Failed to parse json line:" + err.Error()}
+	}
+	event, err := EventFromJSON(obj)
+	if err != nil {
+		return "", &HandlerError{Code: 400, Msg: "Failed to parse json line:" + err.Error()}
+	}
+	self.jsonEvents([]Event{event})
+	self.setRequestFields(event, r)
+	_, _, err = self.SendEvent(event, self.eventSource(r))
+	return event.String("event_id"), err
+}
@@ -0,0 +1,150 @@
+#!/usr/bin/env python3
+# Writes the small MaxMind format databases used by geoip_test.go:
+#   python3 make_geoip.py
+# The records are made up, only the layout follows the real databases.
+import ipaddress
+import struct
+
+CITY = [
+    ("81.2.69.0/24", {
+        "country": {"iso_code": "GB"},
+        "subdivisions": [{"iso_code": "ENG", "names": {"en": "England"}}],
+        "city": {"names": {"en": "London"}},
+    }),
+    ("175.16.199.0/24", {
+        "country": {"iso_code": "CN"},
+        "subdivisions": [{"iso_code": "22", "names": {"en": "Jilin", "zh-CN": "吉林"}}],
+        "city": {"names": {"en": "Changchun", "zh-CN": "长春"}},
+    }),
+    # the region falls back to the iso code without the names
+    ("89.160.20.112/28", {
+        "country": {"iso_code": "SE"},
+        "subdivisions": [{"iso_code": "E"}],
+    }),
+]
+
+ASN = [
+    ("1.128.0.0/11", {
+        "autonomous_system_number": 1221,
+        "autonomous_system_organization": "Telstra Pty Ltd",
+    }),
+    ("81.2.69.0/24", {
+        "autonomous_system_number": 20712,
+        "autonomous_system_organization": "Andrews & Arnold Ltd",
+    }),
+]
+
+
+def control(kind, size):
+    """the control byte, the extended type and the size bytes"""
+    out = bytearray()
+    if kind <= 7:
+        first = kind << 5
+        ext = b""
+    else:
+        first = 0
+        ext = bytes([kind - 7])
+    if size < 29:
+        out.append(first | size)
+        out += ext
+    elif size < 29 + 256:
+        out.append(first | 29)
+        out += ext
+        out.append(size - 29)
+    elif size < 285 + 65536:
+        out.append(first | 30)
+        out += ext
+        out += struct.pack(">H", size - 285)
+    else:
+        out.append(first | 31)
+        out += ext
+        out += struct.pack(">I", size - 65821)[1:]
+    return bytes(out)
+
+
+def encode(value):
+    if isinstance(value, str):
+        data = value.encode("utf-8")
+        return control(2, len(data)) + data
+    if isinstance(value, dict):
+        out = control(7, len(value))
+        for k, v in value.items():
+            out += encode(k) + encode(v)
+        return out
+    if isinstance(value, list):
+        out = control(11, len(value))
+        for v in value:
+            out += encode(v)
+        return out
+    if isinstance(value, int):
+        data = value.to_bytes((value.bit_length() + 7) // 8, "big")
+        # uint32
+        return control(6, len(data)) + data
+    raise TypeError(value)
+
+
+def encode_uint16(value):
+    data = value.to_bytes((value.bit_length() + 7) // 8, "big")
+    return control(5, len(data)) + data
+
+
+def encode_uint64(value):
+    data = value.to_bytes((value.bit_length() + 7) // 8, "big")
+    return control(9, len(data)) + data
+
+
+def write(path, db_type, records):
+    data = bytearray()
+    root = [None, None]
+    for network, record in records:
+        net = ipaddress.ip_network(network)
+        offset = len(data)
+        data += encode(record)
+        bits = int(net.network_address)
+        node = root
+        for i in range(net.prefixlen):
+            bit = (bits >> (31 - i)) & 1
+            if i == net.prefixlen - 1:
+                node[bit] = ("data", offset)
+            else:
+                if not isinstance(node[bit], list):
+                    node[bit] = [None, None]
+                node = node[bit]
+    # number the nodes breadth first
+    nodes = [root]
+    i = 0
+    while i < len(nodes):
+        for child in nodes[i]:
+            if isinstance(child, list):
+                nodes.append(child)
+        i += 1
+    index = {id(node): n for n, node in enumerate(nodes)}
+    count = len(nodes)
+
+    def value(child):
+        if child is None:
+            return count
+        if isinstance(child, list):
+            return index[id(child)]
+        return count + 16 + child[1]
+
+    tree = bytearray()
+    for node in nodes:
+        for child in node:
+            tree += value(child).to_bytes(3, "big")
+    metadata = control(7, 9)
+    metadata += encode("node_count") + encode(count)
+    metadata += encode("record_size") + encode_uint16(24)
+    metadata += encode("ip_version") + encode_uint16(4)
+    metadata += encode("database_type") + encode(db_type)
+    metadata += encode("languages") + encode(["en", "zh-CN"])
+    metadata += encode("binary_format_major_version") + encode_uint16(2)
+    metadata += encode("binary_format_minor_version") + encode_uint16(0)
+    metadata += encode("build_epoch") + encode_uint64(1456000000)
+    metadata += encode("description") + encode({"en": "EventTracker test database"})
+    with open(path, "wb") as f:
+        f.write(tree + b"\0" * 16 + data + b"\xab\xcd\xefMaxMind.com" + metadata)
+
+
+write("geoip-city.mmdb", "GeoIP2-City", CITY)
+write("geoip-asn.mmdb", "GeoLite2-ASN", ASN)
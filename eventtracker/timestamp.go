@@ -0,0 +1,184 @@
+package eventtracker
+
+import (
+	"errors"
+	"github.com/lixin9311/logrus"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TimestampRFC3339 formats timestamps as RFC3339 in UTC, with the
+	// fraction of the second if any
+	TimestampRFC3339 = "rfc3339"
+	// TimestampUnix formats timestamps as unix seconds
+	TimestampUnix = "unix"
+	// TimestampUnixMilli formats timestamps as unix milliseconds
+	TimestampUnixMilli = "unix_ms"
+)
+
+type timestamp_config struct {
+	// Format is the canonical format, rfc3339, unix or unix_ms, unix by
+	// default as the timestamp has always been unix seconds
+	Format string
+	// Max_past and Max_future are the accepted window around the server
+	// time, in go duration format, empty to disable
+	Max_past   string
+	Max_future string
+	// Out_of_window is reject or flag
+	Out_of_window string
+}
+
+// timeLayouts are the accepted ISO-8601 variants, layouts without a zone
+// are in UTC
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// ParseTimestamp parses unix seconds, milliseconds, microseconds or
+// nanoseconds, the unit is detected by the magnitude of the value, and the
+// RFC3339/ISO-8601 variants
+func ParseTimestamp(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, errors.New("Empty timestamp")
+	}
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		switch {
+		case n < 0:
+			return time.Time{}, errors.New("Invalid timestamp: " + value)
+		case n < 1e11:
+			return time.Unix(n, 0).UTC(), nil
+		// divide down to seconds, multiplying up to nanoseconds overflows
+		case n < 1e14:
+			return time.Unix(n/1e3, n%1e3*int64(time.Millisecond)).UTC(), nil
+		case n < 1e17:
+			return time.Unix(n/1e6, n%1e6*int64(time.Microsecond)).UTC(), nil
+		default:
+			return time.Unix(n/1e9, n%1e9).UTC(), nil
+		}
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		if f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+			return time.Time{}, errors.New("Invalid timestamp: " + value)
+		}
+		switch {
+		case f < 1e11:
+			// seconds, until year 5138
+		case f < 1e14:
+			f /= 1e3
+		case f < 1e17:
+			f /= 1e6
+		default:
+			f /= 1e9
+		}
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.UTC); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, errors.New("Unrecognized timestamp: " + value)
+}
+
+// TimestampNormalizer converts timestamps to the canonical format and checks
+// them against the accepted window
+type TimestampNormalizer struct {
+	format    string
+	maxPast   time.Duration
+	maxFuture time.Duration
+	reject    bool
+}
+
+// NewTimestampNormalizer makes a timestamp normalizer
+func NewTimestampNormalizer(w *logrus.Logger, conf timestamp_config) *TimestampNormalizer {
+	self := &TimestampNormalizer{format: conf.Format}
+	switch conf.Format {
+	case "":
+		self.format = TimestampUnix
+	case TimestampRFC3339, TimestampUnix, TimestampUnixMilli:
+	default:
+		w.WithFields(logrus.Fields{
+			"module": "timestamp",
+		}).Fatalln("Unrecognized timestamp format:", conf.Format)
+	}
+	var err error
+	if conf.Max_past != "" {
+		if self.maxPast, err = time.ParseDuration(conf.Max_past); err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "timestamp",
+			}).Fatalln("Invalid max_past:", err)
+		}
+	}
+	if conf.Max_future != "" {
+		if self.maxFuture, err = time.ParseDuration(conf.Max_future); err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "timestamp",
+			}).Fatalln("Invalid max_future:", err)
+		}
+	}
+	switch conf.Out_of_window {
+	case "", "reject":
+		self.reject = true
+	case "flag":
+	default:
+		w.WithFields(logrus.Fields{
+			"module": "timestamp",
+		}).Fatalln("Unrecognized out_of_window policy:", conf.Out_of_window)
+	}
+	return self
+}
+
+// Format formats a time in the canonical format
+func (self *TimestampNormalizer) Format(t time.Time) string {
+	switch self.format {
+	case TimestampUnix:
+		return strconv.FormatInt(t.Unix(), 10)
+	case TimestampUnixMilli:
+		return strconv.FormatInt(t.Unix()*1e3+int64(t.Nanosecond())/int64(time.Millisecond), 10)
+	default:
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+}
+
+// Check returns "past" or "future" if the time is out of the accepted
+// window, empty otherwise
+func (self *TimestampNormalizer) Check(t time.Time) string {
+	now := time.Now()
+	if self.maxPast > 0 && t.Before(now.Add(-self.maxPast)) {
+		return "past"
+	}
+	if self.maxFuture > 0 && t.After(now.Add(self.maxFuture)) {
+		return "future"
+	}
+	return ""
+}
+
+// NormalizeEvent converts the timestamp of the event to the canonical
+// format. Out of window timestamps are rejected, or flagged in the
+// timestamp_flag field.
+func (self *TimestampNormalizer) NormalizeEvent(event Event) error {
+	t, err := ParseTimestamp(event.String("timestamp"))
+	if err != nil {
+		return &HandlerError{Code: 400, Msg: err.Error()}
+	}
+	if flag := self.Check(t); flag != "" {
+		if self.reject {
+			return &HandlerError{Code: 400, Msg: "Timestamp out of window: " + event.String("timestamp")}
+		}
+		event["timestamp_flag"] = flag
+	}
+	event["timestamp"] = self.Format(t)
+	return nil
+}
@@ -0,0 +1,95 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		fail  bool
+	}{
+		{value: "1456000000", want: "2016-02-20T20:26:40Z"},
+		{value: "1456000000123", want: "2016-02-20T20:26:40.123Z"},
+		{value: "1456000000123456", want: "2016-02-20T20:26:40.123456Z"},
+		{value: "1456000000123456789", want: "2016-02-20T20:26:40.123456789Z"},
+		{value: "1456000000.5", want: "2016-02-20T20:26:40.5Z"},
+		{value: " 1456000000 ", want: "2016-02-20T20:26:40Z"},
+		{value: "2016-02-20T20:26:40Z", want: "2016-02-20T20:26:40Z"},
+		{value: "2016-02-21T05:26:40+09:00", want: "2016-02-20T20:26:40Z"},
+		{value: "2016-02-21T05:26:40+0900", want: "2016-02-20T20:26:40Z"},
+		{value: "2016-02-20 20:26:40.25", want: "2016-02-20T20:26:40.25Z"},
+		{value: "2016-02-20", want: "2016-02-20T00:00:00Z"},
+		{value: "", fail: true},
+		{value: "-1", fail: true},
+		{value: "yesterday", fail: true},
+	}
+	for _, test := range tests {
+		got, err := ParseTimestamp(test.value)
+		if (err != nil) != test.fail {
+			t.Errorf("%q: err = %v", test.value, err)
+			continue
+		}
+		if err == nil && got.Format(time.RFC3339Nano) != test.want {
+			t.Errorf("%q = %s, want %s", test.value, got.Format(time.RFC3339Nano), test.want)
+		}
+	}
+}
+
+func TestTimestampFormat(t *testing.T) {
+	ts := time.Unix(1456000000, 123456789)
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{format: "", want: "1456000000"},
+		{format: TimestampUnix, want: "1456000000"},
+		{format: TimestampUnixMilli, want: "1456000000123"},
+		{format: TimestampRFC3339, want: "2016-02-20T20:26:40.123456789Z"},
+	}
+	for _, test := range tests {
+		normalizer := NewTimestampNormalizer(logrus.New(), timestamp_config{Format: test.format})
+		if got := normalizer.Format(ts); got != test.want {
+			t.Errorf("%q: %s, want %s", test.format, got, test.want)
+		}
+	}
+}
+
+func TestTimestampWindow(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		policy string
+		ts     time.Time
+		flag   string
+		fail   bool
+	}{
+		{name: "within the window", ts: now},
+		{name: "too old", ts: now.Add(-48 * time.Hour), fail: true},
+		{name: "too new", ts: now.Add(time.Hour), fail: true},
+		{name: "old flagged", policy: "flag", ts: now.Add(-48 * time.Hour), flag: "past"},
+		{name: "new flagged", policy: "flag", ts: now.Add(time.Hour), flag: "future"},
+	}
+	for _, test := range tests {
+		normalizer := NewTimestampNormalizer(logrus.New(), timestamp_config{Max_past: "24h", Max_future: "10m", Out_of_window: test.policy})
+		event := Event{"timestamp": strconv.FormatInt(test.ts.UnixNano()/int64(time.Millisecond), 10)}
+		err := normalizer.NormalizeEvent(event)
+		if (err != nil) != test.fail {
+			t.Errorf("%s: err = %v", test.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if flag := event.String("timestamp_flag"); flag != test.flag {
+			t.Errorf("%s: flag = %q, want %q", test.name, flag, test.flag)
+		}
+		if want := strconv.FormatInt(test.ts.Unix(), 10); event.String("timestamp") != want {
+			t.Errorf("%s: timestamp = %s, want %s", test.name, event.String("timestamp"), want)
+		}
+	}
+}
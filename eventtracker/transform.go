@@ -0,0 +1,153 @@
+package eventtracker
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/lixin9311/logrus"
+	"hash"
+	"regexp"
+	"strings"
+)
+
+// transform_config is one step of the transform pipeline of an event type
+type transform_config struct {
+	// Op is rename, drop, default, lowercase, uppercase, replace, hash or copy
+	Op    string
+	Field string
+	// To is the target field of rename and copy
+	To string
+	// Value is the value set by default when the field is missing, an empty
+	// value is kept
+	Value string
+	// Pattern and Replacement are the regexp and the replacement of replace,
+	// $1 refers to the first group
+	Pattern     string
+	Replacement string
+	// Algorithm of hash, md5, sha1 or sha256 (default)
+	Algorithm string
+}
+
+type transformStep func(event Event)
+
+// EventTransformer rewrites the fields of events with the pipeline of their
+// event type
+type EventTransformer struct {
+	pipelines map[string][]transformStep
+}
+
+// NewEventTransformer makes the transform pipelines from the event rules,
+// keyed by event type
+func NewEventTransformer(w *logrus.Logger, conf map[string]event_rule_config) *EventTransformer {
+	self := &EventTransformer{pipelines: map[string][]transformStep{}}
+	for event_type, rule_conf := range conf {
+		for i, step_conf := range rule_conf.Transforms {
+			step, err := newTransformStep(step_conf)
+			if err != nil {
+				w.WithFields(logrus.Fields{
+					"module": "transform",
+				}).Fatalf("Invalid transform %d of %s: %s\n", i, event_type, err)
+			}
+			self.pipelines[event_type] = append(self.pipelines[event_type], step)
+		}
+	}
+	return self
+}
+
+func newTransformStep(conf transform_config) (transformStep, error) {
+	field := conf.Field
+	if field == "" {
+		return nil, errors.New("missing field")
+	}
+	switch conf.Op {
+	case "rename", "copy":
+		if conf.To == "" {
+			return nil, errors.New("missing to of " + conf.Op)
+		}
+		to, rename := conf.To, conf.Op == "rename"
+		return func(event Event) {
+			if v, ok := event[field]; ok {
+				event[to] = v
+				if rename {
+					delete(event, field)
+				}
+			}
+		}, nil
+	case "drop":
+		return func(event Event) {
+			delete(event, field)
+		}, nil
+	case "default":
+		value := conf.Value
+		return func(event Event) {
+			if _, ok := event[field]; !ok {
+				event[field] = value
+			}
+		}, nil
+	case "lowercase":
+		return mapValue(field, strings.ToLower), nil
+	case "uppercase":
+		return mapValue(field, strings.ToUpper), nil
+	case "replace":
+		pattern, err := regexp.Compile(conf.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		replacement := conf.Replacement
+		return mapValue(field, func(v string) string {
+			return pattern.ReplaceAllString(v, replacement)
+		}), nil
+	case "hash":
+		var newHash func() hash.Hash
+		switch conf.Algorithm {
+		case "md5":
+			newHash = md5.New
+		case "sha1":
+			newHash = sha1.New
+		case "", "sha256":
+			newHash = sha256.New
+		default:
+			return nil, errors.New("unknown hash algorithm " + conf.Algorithm)
+		}
+		return mapValue(field, func(v string) string {
+			if v == "" {
+				return v
+			}
+			h := newHash()
+			h.Write([]byte(v))
+			return hex.EncodeToString(h.Sum(nil))
+		}), nil
+	default:
+		return nil, errors.New("unknown op " + conf.Op)
+	}
+}
+
+// mapValue applies f to the value of the field, or to every value if the
+// field is a multi value
+func mapValue(field string, f func(string) string) transformStep {
+	return func(event Event) {
+		switch v := event[field].(type) {
+		case string:
+			event[field] = f(v)
+		case []interface{}:
+			event[field] = MultiValue(mapStrings(MultiValueStrings(v), f))
+		}
+	}
+}
+
+func mapStrings(values []string, f func(string) string) []string {
+	for i := range values {
+		values[i] = f(values[i])
+	}
+	return values
+}
+
+// Transform runs the pipeline of the event type on the event, the pipeline is
+// selected by the event type before any step is applied
+func (self *EventTransformer) Transform(event Event) {
+	for _, step := range self.pipelines[event.EventType()] {
+		step(event)
+	}
+}
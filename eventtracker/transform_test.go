@@ -0,0 +1,100 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"reflect"
+	"testing"
+)
+
+func TestEventTransformer(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []transform_config
+		event Event
+		want  Event
+	}{
+		{
+			name:  "rename",
+			steps: []transform_config{{Op: "rename", Field: "uid", To: "user_id"}},
+			event: Event{"uid": "1"},
+			want:  Event{"user_id": "1"},
+		},
+		{
+			name:  "copy",
+			steps: []transform_config{{Op: "copy", Field: "uid", To: "user_id"}},
+			event: Event{"uid": "1"},
+			want:  Event{"uid": "1", "user_id": "1"},
+		},
+		{
+			name:  "drop",
+			steps: []transform_config{{Op: "drop", Field: "debug"}},
+			event: Event{"debug": "1", "uid": "1"},
+			want:  Event{"uid": "1"},
+		},
+		{
+			name:  "default when missing",
+			steps: []transform_config{{Op: "default", Field: "currency", Value: "CNY"}},
+			event: Event{},
+			want:  Event{"currency": "CNY"},
+		},
+		{
+			name:  "default keeps empty and multi values",
+			steps: []transform_config{{Op: "default", Field: "currency", Value: "CNY"}, {Op: "default", Field: "items", Value: "none"}},
+			event: Event{"currency": "", "items": []interface{}{"a", "b"}},
+			want:  Event{"currency": "", "items": []interface{}{"a", "b"}},
+		},
+		{
+			name:  "lowercase multi value",
+			steps: []transform_config{{Op: "lowercase", Field: "items"}},
+			event: Event{"items": []interface{}{"A", "b"}},
+			want:  Event{"items": []interface{}{"a", "b"}},
+		},
+		{
+			name:  "uppercase",
+			steps: []transform_config{{Op: "uppercase", Field: "country"}},
+			event: Event{"country": "cn"},
+			want:  Event{"country": "CN"},
+		},
+		{
+			name:  "replace",
+			steps: []transform_config{{Op: "replace", Field: "price", Pattern: `^(\d+)\.00$`, Replacement: "$1"}},
+			event: Event{"price": "12.00"},
+			want:  Event{"price": "12"},
+		},
+		{
+			name:  "hash",
+			steps: []transform_config{{Op: "hash", Field: "email", Algorithm: "md5"}, {Op: "hash", Field: "phone"}},
+			event: Event{"email": "a@example.com", "phone": ""},
+			want:  Event{"email": "b418773a2c51fb9777a1648346fa7394", "phone": ""},
+		},
+		{
+			name:  "steps run in order",
+			steps: []transform_config{{Op: "rename", Field: "Email", To: "email"}, {Op: "lowercase", Field: "email"}},
+			event: Event{"Email": "A@Example.com"},
+			want:  Event{"email": "a@example.com"},
+		},
+	}
+	for _, test := range tests {
+		transformer := NewEventTransformer(logrus.New(), map[string]event_rule_config{"order": {Transforms: test.steps}})
+		test.event["event_type"] = "order"
+		test.want["event_type"] = "order"
+		transformer.Transform(test.event)
+		if !reflect.DeepEqual(test.event, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, test.event, test.want)
+		}
+	}
+}
+
+func TestTransformStepErrors(t *testing.T) {
+	for _, conf := range []transform_config{
+		{Op: "rename"},
+		{Op: "rename", Field: "a"},
+		{Op: "replace", Field: "a", Pattern: "("},
+		{Op: "hash", Field: "a", Algorithm: "crc32"},
+		{Op: "unknown", Field: "a"},
+	} {
+		if _, err := newTransformStep(conf); err == nil {
+			t.Errorf("%+v: expected an error", conf)
+		}
+	}
+}
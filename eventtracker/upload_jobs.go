@@ -0,0 +1,296 @@
+package eventtracker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/lixin9311/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	jobQueueSize = 1024
+)
+
+// UploadJob is the state of an asynchronous csv upload
+type UploadJob struct {
+	Id      string        `json:"id"`
+	Status  string        `json:"status"`
+	Strict  bool          `json:"strict"`
+	Profile string        `json:"profile,omitempty"`
+	Client  *Client       `json:"client,omitempty"`
+	Ip      string        `json:"ip,omitempty"`
+	Created time.Time     `json:"created"`
+	Updated time.Time     `json:"updated"`
+	Line    int           `json:"line"`
+	Error   string        `json:"error,omitempty"`
+	Report  *UploadReport `json:"report"`
+}
+
+// UploadJobs stores uploaded files on local disk and imports them in
+// background workers. The job state is saved next to the file every
+// checkpoint lines, so unfinished jobs are resumed after a restart from the
+// last checkpoint, the lines after it are sent again. Finished jobs are
+// removed after the ttl.
+type UploadJobs struct {
+	sync.Mutex
+	// MaxFileSize is the maximum size of an uploaded file
+	MaxFileSize int64
+	dir         string
+	checkpoint  int
+	ttl         time.Duration
+	jobs        map[string]*UploadJob
+	queue       chan string
+	handler     *DefaultHandler
+	logger      *logrus.Logger
+}
+
+// NewUploadJobs loads the jobs saved in the job dir and starts the workers
+func NewUploadJobs(w *logrus.Logger, conf upload_config, handler *DefaultHandler) *UploadJobs {
+	if err := os.MkdirAll(conf.Job_dir, 0755); err != nil {
+		w.WithFields(logrus.Fields{
+			"module": "jobs",
+		}).Fatalln("Failed to create job dir:", err)
+	}
+	self := &UploadJobs{MaxFileSize: conf.Max_job_file_size, dir: conf.Job_dir, checkpoint: conf.Checkpoint_lines, ttl: 7 * 24 * time.Hour, jobs: map[string]*UploadJob{}, queue: make(chan string, jobQueueSize), handler: handler, logger: w}
+	if self.MaxFileSize <= 0 {
+		self.MaxFileSize = 1024 * 1024 * 1024
+	}
+	if self.checkpoint <= 0 {
+		self.checkpoint = 1000
+	}
+	if conf.Job_ttl != "" {
+		var err error
+		if self.ttl, err = time.ParseDuration(conf.Job_ttl); err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "jobs",
+			}).Fatalln("Invalid upload job_ttl:", err)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(conf.Job_dir, "*.json"))
+	if err != nil {
+		w.WithFields(logrus.Fields{
+			"module": "jobs",
+		}).Fatalln("Failed to list job dir:", err)
+	}
+	var resume []string
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "jobs",
+			}).Errorln("Failed to read job state:", err)
+			continue
+		}
+		job := &UploadJob{}
+		if err = json.Unmarshal(data, job); err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "jobs",
+			}).Errorln("Failed to parse job state", file, ":", err)
+			continue
+		}
+		self.jobs[job.Id] = job
+		if job.Status == JobPending || job.Status == JobRunning {
+			resume = append(resume, job.Id)
+		}
+	}
+	self.expire(time.Now())
+	go func() {
+		for range time.Tick(time.Hour) {
+			self.expire(time.Now())
+		}
+	}()
+	workers := conf.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go self.worker()
+	}
+	go func() {
+		for _, id := range resume {
+			self.queue <- id
+		}
+	}()
+	w.WithFields(logrus.Fields{
+		"module": "jobs",
+	}).Infof("Init completed, %d jobs loaded, %d jobs to resume.\n", len(self.jobs), len(resume))
+	return self
+}
+
+// newJobId returns a random job id
+func newJobId() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (self *UploadJobs) dataFile(id string) string {
+	return filepath.Join(self.dir, id+".csv")
+}
+
+func (self *UploadJobs) stateFile(id string) string {
+	return filepath.Join(self.dir, id+".json")
+}
+
+// save writes the job state to disk, the caller must hold the lock
+func (self *UploadJobs) save(job *UploadJob) error {
+	job.Updated = time.Now()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	tmp := self.stateFile(job.Id) + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, self.stateFile(job.Id))
+}
+
+// Submit stores the file and queues a new job, client is the authenticated
+// sender of the file, nil if auth is not enabled, and ip its address
+func (self *UploadJobs) Submit(file io.Reader, strict bool, profile string, client *Client, ip string) (*UploadJob, error) {
+	id, err := newJobId()
+	if err != nil {
+		return nil, err
+	}
+	out, err := os.Create(self.dataFile(id))
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(out, file)
+	out.Close()
+	if err != nil {
+		os.Remove(self.dataFile(id))
+		return nil, err
+	}
+	job := &UploadJob{Id: id, Status: JobPending, Strict: strict, Profile: profile, Client: client, Ip: ip, Created: time.Now(), Report: &UploadReport{Errors: []LineError{}}}
+	self.Lock()
+	defer self.Unlock()
+	if err = self.save(job); err != nil {
+		os.Remove(self.dataFile(id))
+		return nil, err
+	}
+	select {
+	case self.queue <- id:
+	default:
+		os.Remove(self.dataFile(id))
+		os.Remove(self.stateFile(id))
+		return nil, errors.New("Too many upload jobs in queue.")
+	}
+	self.jobs[id] = job
+	return job.copy(), nil
+}
+
+// Get returns a copy of the job state
+func (self *UploadJobs) Get(id string) (*UploadJob, bool) {
+	self.Lock()
+	defer self.Unlock()
+	job, ok := self.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	return job.copy(), true
+}
+
+func (self *UploadJob) copy() *UploadJob {
+	job := *self
+	if self.Report != nil {
+		job.Report = self.Report.copy()
+	}
+	return &job
+}
+
+func (self *UploadJobs) worker() {
+	for id := range self.queue {
+		self.run(id)
+	}
+}
+
+// run imports the file of a job, resuming from the saved line
+func (self *UploadJobs) run(id string) {
+	self.Lock()
+	job := self.jobs[id]
+	job.Status = JobRunning
+	self.save(job)
+	resume := job.Line
+	report := job.Report.copy()
+	self.Unlock()
+	logger := self.logger.WithFields(logrus.Fields{
+		"module": "jobs",
+		"job":    id,
+	})
+	logger.Infoln("Upload job started from line:", resume)
+	file, err := os.Open(self.dataFile(id))
+	if err != nil {
+		self.finish(job, report, err)
+		return
+	}
+	defer file.Close()
+	report, err = self.handler.ImportCSV(file, ImportOptions{
+		Strict:           job.Strict,
+		Profile:          job.Profile,
+		Client:           job.Client,
+		Ip:               job.Ip,
+		Report:           report,
+		Resume:           resume,
+		ProgressInterval: self.checkpoint,
+		Progress: func(line int, report *UploadReport) {
+			self.Lock()
+			defer self.Unlock()
+			job.Line = line
+			job.Report = report.copy()
+			if err := self.save(job); err != nil {
+				logger.Errorln("Failed to save job state:", err)
+			}
+		},
+	})
+	self.finish(job, report, err)
+}
+
+// finish saves the final state of a job and removes its file
+func (self *UploadJobs) finish(job *UploadJob, report *UploadReport, err error) {
+	self.Lock()
+	defer self.Unlock()
+	job.Report = report.copy()
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = JobDone
+	}
+	if err := self.save(job); err != nil {
+		self.logger.WithFields(logrus.Fields{
+			"module": "jobs",
+		}).Errorln("Failed to save job state:", err)
+	}
+	os.Remove(self.dataFile(job.Id))
+	self.logger.WithFields(logrus.Fields{
+		"module": "jobs",
+		"job":    job.Id,
+	}).Infoln("Upload job finished:", job.Status, job.Error)
+}
+
+// expire removes the finished jobs which have not been updated within the ttl
+func (self *UploadJobs) expire(now time.Time) {
+	self.Lock()
+	defer self.Unlock()
+	for id, job := range self.jobs {
+		if (job.Status == JobDone || job.Status == JobFailed) && now.Sub(job.Updated) > self.ttl {
+			delete(self.jobs, id)
+			os.Remove(self.stateFile(id))
+		}
+	}
+}
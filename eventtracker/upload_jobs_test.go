@@ -0,0 +1,155 @@
+package eventtracker
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/lixin9311/logrus"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitJob waits until the job is finished
+func waitJob(t *testing.T, jobs *UploadJobs, id string) *UploadJob {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, ok := jobs.Get(id)
+		if !ok {
+			t.Fatal("job not found:", id)
+		}
+		if job.Status == JobDone || job.Status == JobFailed {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("job not finished:", id)
+	return nil
+}
+
+func TestUploadJobsSubmit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	handler, producer := newTestHandler(t)
+	handler.Timestamps = NewTimestampNormalizer(logrus.New(), timestamp_config{})
+	jobs := NewUploadJobs(logrus.New(), upload_config{Job_dir: dir, Checkpoint_lines: 1}, handler)
+	job, err := jobs.Submit(strings.NewReader(testCSV), false, "", nil, "1.1.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitJob(t, jobs, job.Id)
+	if job.Status != JobDone || job.Report.Accepted != 2 || job.Report.Rejected != 2 || len(producer.messages) != 2 {
+		t.Errorf("job = %+v, report = %+v, %d messages", job, job.Report, len(producer.messages))
+	}
+	if _, err := os.Stat(filepath.Join(dir, job.Id+".csv")); !os.IsNotExist(err) {
+		t.Error("the data file is not removed:", err)
+	}
+	if _, ok := jobs.Get("unknown"); ok {
+		t.Error("unknown job found")
+	}
+}
+
+func TestUploadJobsResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the job crashed after the checkpoint at line 3
+	job := &UploadJob{Id: "resumed", Status: JobRunning, Line: 3, Report: &UploadReport{Accepted: 1, Rejected: 1, Errors: []LineError{{Line: 3}}}}
+	data, _ := json.Marshal(job)
+	ioutil.WriteFile(filepath.Join(dir, "resumed.json"), data, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "resumed.csv"), []byte(testCSV), 0644)
+	handler, producer := newTestHandler(t)
+	handler.Timestamps = NewTimestampNormalizer(logrus.New(), timestamp_config{})
+	jobs := NewUploadJobs(logrus.New(), upload_config{Job_dir: dir}, handler)
+	job = waitJob(t, jobs, "resumed")
+	if job.Status != JobDone || job.Report.Accepted != 2 || job.Report.Rejected != 2 || len(producer.messages) != 1 {
+		t.Errorf("job = %+v, report = %+v, %d messages", job, job.Report, len(producer.messages))
+	}
+}
+
+func TestUploadJobsExpire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := time.Now().Add(-2 * time.Hour)
+	for _, job := range []*UploadJob{
+		{Id: "old", Status: JobDone, Updated: old, Report: &UploadReport{}},
+		{Id: "failed", Status: JobFailed, Updated: old, Report: &UploadReport{}},
+		{Id: "recent", Status: JobDone, Updated: time.Now(), Report: &UploadReport{}},
+	} {
+		data, _ := json.Marshal(job)
+		ioutil.WriteFile(filepath.Join(dir, job.Id+".json"), data, 0644)
+	}
+	handler, _ := newTestHandler(t)
+	jobs := NewUploadJobs(logrus.New(), upload_config{Job_dir: dir, Job_ttl: "1h"}, handler)
+	for _, id := range []string{"old", "failed"} {
+		if _, ok := jobs.Get(id); ok {
+			t.Errorf("job %s is not expired", id)
+		}
+		if _, err := os.Stat(filepath.Join(dir, id+".json")); !os.IsNotExist(err) {
+			t.Errorf("the state of job %s is not removed: %v", id, err)
+		}
+	}
+	if _, ok := jobs.Get("recent"); !ok {
+		t.Error("recent job is expired")
+	}
+}
+
+// uploadRequest makes a multipart upload of the csv
+func uploadRequest(t *testing.T, csv string, async bool) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("uploadfile", "events.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(csv))
+	if async {
+		writer.WriteField("async", "true")
+	}
+	writer.Close()
+	r := httptest.NewRequest("POST", "/upload", body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	return r
+}
+
+func TestUploadFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	handler, _ := newTestHandler(t)
+	handler.MaxFileSize = 64
+	handler.Jobs = NewUploadJobs(logrus.New(), upload_config{Job_dir: dir, Max_job_file_size: 1024}, handler)
+	tests := []struct {
+		name  string
+		csv   string
+		async bool
+		code  int
+	}{
+		{name: "small file", csv: "did,timestamp,event_type\na,1456000000,open\n", code: 200},
+		{name: "large file", csv: testCSV, code: 400},
+		{name: "large asynchronous file", csv: testCSV, async: true, code: 202},
+		{name: "too large asynchronous file", csv: strings.Repeat(testCSV, 20), async: true, code: 400},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler.UploadHandler(w, uploadRequest(t, test.csv, test.async))
+		if w.Code != test.code {
+			t.Errorf("%s: code = %d, want %d: %s", test.name, w.Code, test.code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package eventtracker
+
+import (
+	"encoding/json"
+	"github.com/lixin9311/logrus"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type useragent_config struct {
+	Enabled bool
+	// Rules is the json file of the user agent regexps
+	Rules string
+	// Reload_interval is the interval to check the rules file for changes
+	Reload_interval string
+}
+
+// uaRuleConfig is one rule of the rules file, the templates may refer to
+// the groups of the regex as $1, $2...
+type uaRuleConfig struct {
+	Regex   string `json:"regex"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Model   string `json:"model"`
+}
+
+// uaRulesConfig is the rules file, the first matched rule of each section wins
+type uaRulesConfig struct {
+	Bots     []string       `json:"bots"`
+	Os       []uaRuleConfig `json:"os"`
+	Devices  []uaRuleConfig `json:"devices"`
+	Browsers []uaRuleConfig `json:"browsers"`
+}
+
+type uaRule struct {
+	uaRuleConfig
+	regex *regexp.Regexp
+}
+
+type uaRules struct {
+	bots     []*regexp.Regexp
+	os       []*uaRule
+	devices  []*uaRule
+	browsers []*uaRule
+}
+
+// UserAgentParser parses the user_agent field of an event into os,
+// os_version, device_model, browser, browser_version and is_bot. Fields
+// declared by the client are dropped, so the bot detection can not be
+// skipped.
+type UserAgentParser struct {
+	sync.RWMutex
+	path    string
+	modTime time.Time
+	rules   *uaRules
+	logger  *logrus.Logger
+}
+
+// NewUserAgentParser loads the rules and starts watching the file for changes
+func NewUserAgentParser(w *logrus.Logger, conf useragent_config) *UserAgentParser {
+	self := &UserAgentParser{path: conf.Rules, logger: w}
+	if _, err := self.load(true); err != nil {
+		w.WithFields(logrus.Fields{
+			"module": "useragent",
+		}).Fatalln("Failed to load user agent rules:", err)
+	}
+	interval := time.Minute
+	if conf.Reload_interval != "" {
+		var err error
+		if interval, err = time.ParseDuration(conf.Reload_interval); err != nil {
+			w.WithFields(logrus.Fields{
+				"module": "useragent",
+			}).Fatalln("Invalid useragent reload_interval:", err)
+		}
+	}
+	go func() {
+		for range time.Tick(interval) {
+			self.Reload(false)
+		}
+	}()
+	w.WithFields(logrus.Fields{
+		"module": "useragent",
+	}).Infoln("Init completed.")
+	return self
+}
+
+// Reload loads the rules again if the file has changed or force is set
+func (self *UserAgentParser) Reload(force bool) {
+	reloaded, err := self.load(force)
+	if err != nil {
+		self.logger.WithFields(logrus.Fields{
+			"module": "useragent",
+		}).Errorln("Failed to reload user agent rules:", err)
+	} else if reloaded {
+		self.logger.WithFields(logrus.Fields{
+			"module": "useragent",
+		}).Infoln("Reloaded user agent rules:", self.path)
+	}
+}
+
+func (self *UserAgentParser) load(force bool) (bool, error) {
+	info, err := os.Stat(self.path)
+	if err != nil {
+		return false, err
+	}
+	if !force && info.ModTime().Equal(self.modTime) {
+		return false, nil
+	}
+	data, err := ioutil.ReadFile(self.path)
+	if err != nil {
+		return false, err
+	}
+	var conf uaRulesConfig
+	if err = json.Unmarshal(data, &conf); err != nil {
+		return false, err
+	}
+	rules := &uaRules{}
+	for _, v := range conf.Bots {
+		regex, err := regexp.Compile(v)
+		if err != nil {
+			return false, err
+		}
+		rules.bots = append(rules.bots, regex)
+	}
+	if rules.os, err = compileUARules(conf.Os); err != nil {
+		return false, err
+	}
+	if rules.devices, err = compileUARules(conf.Devices); err != nil {
+		return false, err
+	}
+	if rules.browsers, err = compileUARules(conf.Browsers); err != nil {
+		return false, err
+	}
+	self.Lock()
+	self.rules = rules
+	self.modTime = info.ModTime()
+	self.Unlock()
+	return true, nil
+}
+
+func compileUARules(confs []uaRuleConfig) ([]*uaRule, error) {
+	var rules []*uaRule
+	for _, conf := range confs {
+		regex, err := regexp.Compile(conf.Regex)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, &uaRule{uaRuleConfig: conf, regex: regex})
+	}
+	return rules, nil
+}
+
+// matchUARules returns the expanded name, version and model of the first matched rule
+func matchUARules(rules []*uaRule, ua string) (name, version, model string, ok bool) {
+	for _, rule := range rules {
+		match := rule.regex.FindStringSubmatchIndex(ua)
+		if match == nil {
+			continue
+		}
+		expand := func(template string) string {
+			value := string(rule.regex.ExpandString(nil, template, ua, match))
+			// drop the separators of the missing optional groups
+			return strings.TrimSpace(strings.TrimRight(value, "._ "))
+		}
+		return expand(rule.Name), strings.Replace(expand(rule.Version), "_", ".", -1), expand(rule.Model), true
+	}
+	return "", "", "", false
+}
+
+// uaFields are the fields parsed from the user agent
+var uaFields = []string{"os", "os_version", "device_model", "browser", "browser_version", "is_bot"}
+
+// Enrich parses the user_agent field of the event
+func (self *UserAgentParser) Enrich(event Event) error {
+	for _, k := range uaFields {
+		delete(event, k)
+	}
+	ua := event.String("user_agent")
+	if ua == "" {
+		return nil
+	}
+	self.RLock()
+	rules := self.rules
+	self.RUnlock()
+	bot := false
+	for _, regex := range rules.bots {
+		if regex.MatchString(ua) {
+			bot = true
+			break
+		}
+	}
+	event["is_bot"] = strconv.FormatBool(bot)
+	if name, version, _, ok := matchUARules(rules.os, ua); ok {
+		setNonEmpty(event, "os", name)
+		setNonEmpty(event, "os_version", version)
+	}
+	if _, _, model, ok := matchUARules(rules.devices, ua); ok {
+		setNonEmpty(event, "device_model", model)
+	}
+	if name, version, _, ok := matchUARules(rules.browsers, ua); ok {
+		setNonEmpty(event, "browser", name)
+		setNonEmpty(event, "browser_version", version)
+	}
+	return nil
+}
+
+// setDefault sets a non empty value if the event does not have the key
+func setDefault(event Event, key, value string) {
+	if _, ok := event[key]; !ok && value != "" {
+		event[key] = value
+	}
+}
+
+// SetUserAgent records the User-Agent header in the user_agent field, unless
+// the client declared one
+func (self Event) SetUserAgent(ua string) {
+	setDefault(self, "user_agent", ua)
+}
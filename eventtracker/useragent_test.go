@@ -0,0 +1,77 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"reflect"
+	"testing"
+)
+
+func TestMatchUARules(t *testing.T) {
+	rules, err := compileUARules([]uaRuleConfig{
+		{Regex: `(?:iPhone|CPU) OS (\d+)_(\d+)(?:_(\d+))?`, Name: "iOS", Version: "$1.$2.$3"},
+		{Regex: `Android[ /]?(\d+(?:\.\d+)*)?`, Name: "Android", Version: "$1"},
+		{Regex: `Build/(\w+)`, Name: "${1}_$2", Model: "$2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		ua      string
+		want    []string
+		matched bool
+	}{
+		{name: "all groups", ua: "Mozilla/5.0 (iPhone; CPU iPhone OS 10_3_1 like Mac OS X)", want: []string{"iOS", "10.3.1", ""}, matched: true},
+		{name: "missing optional group", ua: "Mozilla/5.0 (iPhone; CPU iPhone OS 10_3 like Mac OS X)", want: []string{"iOS", "10.3", ""}, matched: true},
+		{name: "missing version", ua: "Mozilla/5.0 (Linux; Android; Nexus 5)", want: []string{"Android", "", ""}, matched: true},
+		{name: "the first rule wins", ua: "Android 7.0 Build/NRD90M", want: []string{"Android", "7.0", ""}, matched: true},
+		{name: "undefined group", ua: "Build/NRD90M", want: []string{"NRD90M", "", ""}, matched: true},
+		{name: "no match", ua: "curl/7.47.0", want: []string{"", "", ""}},
+	}
+	for _, test := range tests {
+		name, version, model, ok := matchUARules(rules, test.ua)
+		if got := []string{name, version, model}; ok != test.matched || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, %v, want %q", test.name, got, ok, test.want)
+		}
+	}
+}
+
+func TestUserAgentEnrich(t *testing.T) {
+	parser := NewUserAgentParser(logrus.New(), useragent_config{Rules: "../example_config/ua_rules.json"})
+	tests := []struct {
+		name  string
+		event Event
+		want  Event
+	}{
+		{
+			name:  "mobile safari",
+			event: Event{"user_agent": "Mozilla/5.0 (iPhone; CPU iPhone OS 10_3 like Mac OS X) AppleWebKit/603.1.30 (KHTML, like Gecko) Version/10.0 Mobile/14E277 Safari/602.1"},
+			want:  Event{"os": "iOS", "os_version": "10.3", "device_model": "iPhone", "browser": "Safari", "browser_version": "10.0", "is_bot": "false"},
+		},
+		{
+			name:  "bot can not pretend to be a human",
+			event: Event{"user_agent": "curl/7.47.0", "is_bot": "false"},
+			want:  Event{"is_bot": "true"},
+		},
+		{
+			name:  "parsed fields are not taken from the client",
+			event: Event{"user_agent": "Mozilla/5.0 (Linux; Android 7.0; Nexus 5 Build/NRD90M)", "os": "iOS", "browser": "Chrome"},
+			want:  Event{"os": "Android", "os_version": "7.0", "device_model": "Nexus 5", "is_bot": "false"},
+		},
+		{
+			name:  "no user agent",
+			event: Event{"os": "iOS", "is_bot": "false"},
+			want:  Event{},
+		},
+	}
+	for _, test := range tests {
+		if err := parser.Enrich(test.event); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		delete(test.event, "user_agent")
+		if !reflect.DeepEqual(test.event, test.want) {
+			t.Errorf("%s: event = %v, want %v", test.name, test.event, test.want)
+		}
+	}
+}
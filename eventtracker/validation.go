@@ -0,0 +1,141 @@
+package eventtracker
+
+import (
+	"fmt"
+	"github.com/lixin9311/logrus"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// field_rule_config constrains the value of one field
+type field_rule_config struct {
+	// Type is string, int, number or bool
+	Type string
+	// Allowed lists the allowed values, empty to allow any
+	Allowed []string
+	// Pattern is a regexp the whole value must match
+	Pattern string
+	// Max_length is the maximum length of the value, 0 for no limit
+	Max_length int
+}
+
+// event_rule_config is the validation rules of one event type
+type event_rule_config struct {
+	// Required fields besides did, timestamp and event_type
+	Required []string
+	Fields   map[string]field_rule_config
+	// Transforms are applied in order before the event is checked
+	Transforms []transform_config
+}
+
+type fieldRule struct {
+	field_rule_config
+	pattern *regexp.Regexp
+}
+
+type eventRule struct {
+	required []string
+	fields   map[string]*fieldRule
+}
+
+// EventValidator checks events against the rules of their event type
+type EventValidator struct {
+	rules map[string]*eventRule
+}
+
+// NewEventValidator makes a validator from the event rules, keyed by event type
+func NewEventValidator(w *logrus.Logger, conf map[string]event_rule_config) *EventValidator {
+	self := &EventValidator{rules: map[string]*eventRule{}}
+	for event_type, rule_conf := range conf {
+		rule := &eventRule{required: rule_conf.Required, fields: map[string]*fieldRule{}}
+		for field, field_conf := range rule_conf.Fields {
+			switch field_conf.Type {
+			case "", "string", "int", "number", "bool":
+			default:
+				w.WithFields(logrus.Fields{
+					"module": "validation",
+				}).Fatalf("Unknown type %s of %s.%s\n", field_conf.Type, event_type, field)
+			}
+			frule := &fieldRule{field_rule_config: field_conf}
+			if field_conf.Pattern != "" {
+				pattern, err := regexp.Compile("^(?:" + field_conf.Pattern + ")$")
+				if err != nil {
+					w.WithFields(logrus.Fields{
+						"module": "validation",
+					}).Fatalf("Invalid pattern of %s.%s: %s\n", event_type, field, err)
+				}
+				frule.pattern = pattern
+			}
+			rule.fields[field] = frule
+		}
+		self.rules[event_type] = rule
+	}
+	return self
+}
+
+// Validate checks the event, the returned error lists every violation
+func (self *EventValidator) Validate(event Event) error {
+	rule, ok := self.rules[event.EventType()]
+	if !ok {
+		return nil
+	}
+	var violations []string
+	for _, field := range rule.required {
+		if _, ok := event[field]; !ok {
+			violations = append(violations, "missing required field "+field)
+		}
+	}
+	for field, frule := range rule.fields {
+		value, ok := event[field]
+		if !ok {
+			continue
+		}
+		if values, ok := value.([]interface{}); ok {
+			for _, v := range values {
+				violations = append(violations, frule.check(field, fmt.Sprint(v))...)
+			}
+		} else {
+			violations = append(violations, frule.check(field, fmt.Sprint(value))...)
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return &HandlerError{Code: 400, Msg: "Invalid " + event.EventType() + " event: " + strings.Join(violations, "; "), Violations: violations}
+}
+
+func (self *fieldRule) check(field, value string) []string {
+	var violations []string
+	var err error
+	switch self.Type {
+	case "int":
+		_, err = strconv.ParseInt(value, 10, 64)
+	case "number":
+		_, err = strconv.ParseFloat(value, 64)
+	case "bool":
+		_, err = strconv.ParseBool(value)
+	}
+	if err != nil {
+		violations = append(violations, fmt.Sprintf("%s is not a valid %s: %q", field, self.Type, value))
+	}
+	if len(self.Allowed) > 0 {
+		allowed := false
+		for _, v := range self.Allowed {
+			if v == value {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			violations = append(violations, fmt.Sprintf("%s must be one of %s: %q", field, strings.Join(self.Allowed, ","), value))
+		}
+	}
+	if self.pattern != nil && !self.pattern.MatchString(value) {
+		violations = append(violations, fmt.Sprintf("%s does not match %s: %q", field, self.Pattern, value))
+	}
+	if self.Max_length > 0 && len(value) > self.Max_length {
+		violations = append(violations, fmt.Sprintf("%s is longer than %d", field, self.Max_length))
+	}
+	return violations
+}
@@ -0,0 +1,93 @@
+package eventtracker
+
+import (
+	"github.com/lixin9311/logrus"
+	"testing"
+)
+
+func TestEventValidator(t *testing.T) {
+	validator := NewEventValidator(logrus.New(), map[string]event_rule_config{
+		"order": {
+			Required: []string{"order_id"},
+			Fields: map[string]field_rule_config{
+				"amount":   {Type: "number"},
+				"count":    {Type: "int"},
+				"paid":     {Type: "bool"},
+				"currency": {Allowed: []string{"CNY", "USD"}},
+				"order_id": {Pattern: "[0-9a-f]+", Max_length: 8},
+			},
+		},
+	})
+	tests := []struct {
+		name       string
+		event      Event
+		violations []string
+	}{
+		{
+			name:  "valid",
+			event: Event{"event_type": "order", "order_id": "abc1", "amount": "9.9", "count": "2", "paid": "true", "currency": "CNY"},
+		},
+		{
+			name:  "other event type",
+			event: Event{"event_type": "click"},
+		},
+		{
+			name:       "missing required",
+			event:      Event{"event_type": "order"},
+			violations: []string{"missing required field order_id"},
+		},
+		{
+			name:       "wrong types",
+			event:      Event{"event_type": "order", "order_id": "1", "amount": "x", "count": "1.5", "paid": "yes"},
+			violations: []string{`amount is not a valid number: "x"`, `count is not a valid int: "1.5"`, `paid is not a valid bool: "yes"`},
+		},
+		{
+			name:       "not allowed",
+			event:      Event{"event_type": "order", "order_id": "1", "currency": "EUR"},
+			violations: []string{`currency must be one of CNY,USD: "EUR"`},
+		},
+		{
+			name:       "pattern and length",
+			event:      Event{"event_type": "order", "order_id": "0123456789"},
+			violations: []string{"order_id is longer than 8"},
+		},
+		{
+			name:       "pattern matches the whole value",
+			event:      Event{"event_type": "order", "order_id": "12xy"},
+			violations: []string{`order_id does not match [0-9a-f]+: "12xy"`},
+		},
+		{
+			name:       "every value of a multi value",
+			event:      Event{"event_type": "order", "order_id": "1", "currency": []interface{}{"CNY", "JPY"}},
+			violations: []string{`currency must be one of CNY,USD: "JPY"`},
+		},
+	}
+	for _, test := range tests {
+		err := validator.Validate(test.event)
+		var violations []string
+		if err != nil {
+			violations = err.(*HandlerError).Violations
+		}
+		if !sameViolations(violations, test.violations) {
+			t.Errorf("%s: violations = %q, want %q", test.name, violations, test.violations)
+		}
+	}
+}
+
+// sameViolations compares the violations regardless of the order, the
+// fields are checked in the map order
+func sameViolations(a, b []string) bool {
+	count := map[string]int{}
+	for _, v := range a {
+		count[v]++
+	}
+	for _, v := range b {
+		count[v]--
+	}
+	for _, n := range count {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,16 @@
+// process is called with every event in the layout of the avro record:
+// event.did, event.aid, event.ip, event.timestamp, event.event_id and the
+// other fields in event.extension. Modify the event in place, return false to
+// drop it, or return a topic name to send it to that topic.
+function process(event) {
+	var ext = event.extension;
+	if (ext.test === "true") {
+		return false;
+	}
+	if (ext.idfa) {
+		ext.idfa = ext.idfa.toUpperCase();
+	}
+	if (ext.event_type === "order" && parseFloat(ext.amount) >= 10000) {
+		return "large-orders";
+	}
+}
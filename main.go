@@ -11,6 +11,8 @@ import (
 	"net/http"
 	"net/rpc"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var (
@@ -85,6 +87,76 @@ func init() {
 	// init kafka
 	kafka = et.NewKafkaInst(log, conf.Kafka)
 	defaultHandler = et.NewDefaultHandler(log, fail_safe, kafka, avro)
+	if conf.Stream.Max_lines > 0 {
+		defaultHandler.MaxStreamLines = conf.Stream.Max_lines
+	}
+	if conf.Stream.Max_line_size > 0 {
+		defaultHandler.MaxStreamLineSize = conf.Stream.Max_line_size
+	}
+	if conf.Stream.Progress_interval > 0 {
+		defaultHandler.StreamProgressInterval = conf.Stream.Progress_interval
+	}
+	defaultHandler.Proxies = et.NewIPResolver(log, conf.Proxy)
+	defaultHandler.MultiValue = et.NewMultiValuePolicy(log, conf.Multi_value, avro)
+	if conf.Auth.Enabled {
+		defaultHandler.Auth = et.NewAuthenticator(log, conf.Auth)
+	}
+	if conf.Ratelimit.Enabled {
+		defaultHandler.RateLimiter = et.NewRateLimiter(log, conf.Ratelimit)
+	}
+	defaultHandler.Transformer = et.NewEventTransformer(log, conf.Events)
+	defaultHandler.Validator = et.NewEventValidator(log, conf.Events)
+	defaultHandler.Timestamps = et.NewTimestampNormalizer(log, conf.Timestamp)
+	if conf.Device_id.Enabled {
+		defaultHandler.DeviceIds = et.NewDeviceIdNormalizer(log, conf.Device_id)
+	}
+	if conf.Dedup.Enabled {
+		defaultHandler.Dedup = et.NewDeduplicator(log, conf.Dedup)
+	}
+	// init enrichment
+	if conf.Geoip.Enabled {
+		defaultHandler.Enrichers = append(defaultHandler.Enrichers, et.NewGeoIP(log, conf.Geoip))
+	}
+	if conf.Useragent.Enabled {
+		defaultHandler.Enrichers = append(defaultHandler.Enrichers, et.NewUserAgentParser(log, conf.Useragent))
+	}
+	for _, lookup := range conf.Lookup {
+		defaultHandler.Enrichers = append(defaultHandler.Enrichers, et.NewLookupTable(log, lookup))
+	}
+	for _, script := range conf.Script {
+		defaultHandler.Enrichers = append(defaultHandler.Enrichers, et.NewScript(log, script))
+	}
+	if conf.Consent.Enabled {
+		defaultHandler.Consent = et.NewConsentChecker(log, conf.Consent)
+	}
+	defaultHandler.PII = et.NewPIIProtector(log, conf.Pii)
+	// reload the enrichment and key files on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.WithFields(logrus.Fields{
+				"module": "main",
+			}).Infoln("SIGHUP received, reloading enrichment and key files.")
+			for _, enricher := range defaultHandler.Enrichers {
+				if reloader, ok := enricher.(et.Reloader); ok {
+					reloader.Reload(true)
+				}
+			}
+			defaultHandler.PII.Reload(true)
+			if defaultHandler.Auth != nil {
+				defaultHandler.Auth.Reload(true)
+			}
+		}
+	}()
+	if conf.Click.Enabled {
+		defaultHandler.Clicks = et.NewClickRedirector(log, conf.Click)
+	}
+	defaultHandler.Profiles = et.NewColumnProfiles(log, conf.Upload)
+	// init asynchronous upload
+	if conf.Upload.Job_dir != "" {
+		defaultHandler.Jobs = et.NewUploadJobs(log, conf.Upload, defaultHandler)
+	}
 	log.WithFields(logrus.Fields{
 		"module": "main",
 	}).Infoln("Initialization done.")
@@ -100,9 +172,66 @@ func main() {
 	// REST route
 	r := mux.NewRouter()
 	r.HandleFunc("/", defaultHandler.HomeHandler)
-	r.HandleFunc("/event", defaultHandler.EventHandler)
-	r.HandleFunc("/upload", defaultHandler.UploadHandler)
+	// the endpoints writing events require an api key if auth is enabled,
+	// and are rate limited by the client
+	auth := func(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+		handler = defaultHandler.RateLimit(endpoint, handler)
+		if defaultHandler.Auth == nil {
+			return handler
+		}
+		return defaultHandler.Auth.Wrap(endpoint, handler)
+	}
+	// [signing.event] signs the endpoints writing events, the signature
+	// covers the api key, so it is checked first
+	var signer *et.Signer
+	if signing, ok := conf.Signing["event"]; ok {
+		signer = et.NewSigner(log, signing)
+	}
+	sign := func(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+		if signer == nil || !signer.Signs(endpoint) {
+			return handler
+		}
+		return signer.Wrap(handler)
+	}
+	// the json endpoints may be called from the browsers
+	var corsHandler *et.CORS
+	if len(conf.Cors.Allowed_origins) != 0 {
+		corsHandler = et.NewCORS(log, conf.Cors)
+	}
+	cors := func(handler http.HandlerFunc) http.HandlerFunc {
+		if corsHandler == nil {
+			return handler
+		}
+		return corsHandler.Wrap(handler)
+	}
+	r.HandleFunc("/event", cors(sign("/event", auth("/event", defaultHandler.EventHandler))))
+	r.HandleFunc("/upload", auth("/upload", defaultHandler.UploadHandler))
+	r.HandleFunc("/upload/{id}", auth("/upload", defaultHandler.UploadJobHandler)).Methods("GET")
+	// the stream is only signed if listed, the signed body is read into
+	// memory as a whole
+	streamHandler := auth("/events/stream", defaultHandler.StreamHandler)
+	if signer != nil && signer.Lists("/events/stream") {
+		streamHandler = signer.Wrap(streamHandler)
+	}
+	r.HandleFunc("/events/stream", cors(streamHandler))
+	r.HandleFunc("/pixel.gif", sign("/pixel.gif", auth("/pixel.gif", defaultHandler.PixelHandler))).Methods("GET")
+	r.HandleFunc("/beacon", cors(sign("/beacon", auth("/beacon", defaultHandler.BeaconHandler))))
+	// the ad links are opened by the users and can not carry an api key or a
+	// nonce, they are checked by the allowed hosts or the signed urls of
+	// [click], and rate limited by the ip
+	clickHandler := defaultHandler.RateLimit("/click", defaultHandler.ClickHandler)
+	if signer != nil && signer.Lists("/click") {
+		clickHandler = signer.Wrap(clickHandler)
+	}
+	r.HandleFunc("/click", clickHandler).Methods("GET")
 	r.HandleFunc("/ping", et.PingHandler)
+	// admin api
+	if conf.Main.Admin_token != "" {
+		r.Handle("/admin/opt-out", et.AdminOnly(conf.Main.Admin_token, http.HandlerFunc(defaultHandler.OptOutHandler)))
+		r.Handle("/admin/quota", et.AdminOnly(conf.Main.Admin_token, http.HandlerFunc(defaultHandler.QuotaHandler)))
+		r.Handle("/lookup/stats", et.AdminOnly(conf.Main.Admin_token, http.HandlerFunc(defaultHandler.LookupStatsHandler))).Methods("GET")
+		r.Handle("/scripts/stats", et.AdminOnly(conf.Main.Admin_token, http.HandlerFunc(defaultHandler.ScriptStatsHandler))).Methods("GET")
+	}
 	// bring up the service
 	var ln net.Listener
 	if conf.Front.Enabled == true {
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"crypto/md5"
 	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
@@ -18,23 +17,23 @@ import (
 	//"net/url"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"time"
 )
 
 var (
 	configFile = flag.String("c", "config.toml", "config file.")
-	sign_check = flag.Bool("f", false, "Force pass sign check.")
 	log        *logrus.Logger
 	conf       *et.Config
 	transport  = http.Transport{MaxIdleConnsPerHost: 200}
 	client     = &http.Client{Transport: &transport}
 	// Fail safe buffer file
-	fail_safe *golog.Logger
-	address   []string
-	kafka     *et.Kafka
-	avro      *et.Avro
+	fail_safe  *golog.Logger
+	address    []string
+	kafka      *et.Kafka
+	avro       *et.Avro
+	timestamps *et.TimestampNormalizer
+	signer     *et.Signer
 )
 
 func readKafka() {
@@ -128,7 +127,7 @@ func readKafka() {
 			}).Errorln("Failed to get timestamp:", err)
 			continue
 		}
-		t, err := time.Parse(time.RFC3339, cts.(string))
+		t, err := et.ParseTimestamp(cts.(string))
 		if err != nil {
 			log.WithFields(logrus.Fields{
 				"module": "adwo",
@@ -148,13 +147,17 @@ func readKafka() {
 			continue
 		}
 		for k, v := range ext_map {
+			if values, ok := v.([]interface{}); ok && len(values) > 0 {
+				// repeated parameters, use the first one
+				v = values[0]
+				ext_map[k] = v
+			}
 			if _, ok := v.(string); !ok {
 				log.WithFields(logrus.Fields{
 					"module": "adwo",
 				}).Warnf("%s unkown\n", k)
 				ext_map[k] = "unknown"
-			}
-			if v.(string) == "" {
+			} else if v.(string) == "" {
 				log.WithFields(logrus.Fields{
 					"module": "adwo",
 				}).Warnf("%s unkown\n", k)
@@ -257,26 +260,11 @@ func EventHandler(w http.ResponseWriter, r *http.Request) {
 		ErrorAndReturnCode(w, "Missing Required field: No ts", 400)
 		return
 	}
-	if len(r.Form["sign"]) < 1 {
-		ErrorAndReturnCode(w, "Missing Required field: No sign", 400)
-		return
-	}
 	if len(r.Form["keyword"]) < 1 {
 		ErrorAndReturnCode(w, "Missing Required field: No keyword", 400)
 		return
 	}
-	// set a new avro record
-	str := fmt.Sprintf("adid=%sadname=%sappid=%sdevice=%sidfa=%spoint=%sts=%skey=%s", r.Form["adid"][0], r.Form["adname"][0], r.Form["appid"][0], r.Form["device"][0], r.Form["idfa"][0], r.Form["point"][0], r.Form["ts"][0], conf.Extension.Anwo.Key)
-	crypted := md5.Sum([]byte(str))
-	if fmt.Sprintf("%x", crypted) != strings.Split(r.Form["sign"][0], ",")[0] {
-		log.WithFields(logrus.Fields{
-			"module": "adwo",
-		}).Warnf("Sign not matched!: %x :%s\n, bypass sign check? %s", crypted, r.Form["sign"][0], *sign_check)
-		if !*sign_check {
-			ErrorAndReturnCode(w, "Sign mismatched!", 400)
-			return
-		}
-	}
+	// set a new avro record, the sign has been checked by the signer
 	record, err := avro.NewRecord()
 	if err != nil {
 		ErrorAndReturnCode(w, "Failed to set a new avro record:"+err.Error(), 500)
@@ -288,16 +276,15 @@ func EventHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	// set required fields
 	record.Set("did", r.Form["idfa"][0])
-	nsec, err := strconv.ParseInt(r.Form["ts"][0], 10, 64)
+	t, err := et.ParseTimestamp(r.Form["ts"][0])
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"module": "adwo",
-		}).Errorln("Failed to parse ts to int:", err)
+		}).Errorln("Failed to parse ts:", err)
 		ErrorAndReturnCode(w, "Failed to parse ts:"+err.Error(), 500)
 		return
 	}
-	t := time.Unix(0, nsec*1000000)
-	record.Set("timestamp", t.Format(time.RFC3339))
+	record.Set("timestamp", timestamps.Format(t))
 	record.Set("id", r.Form["keyword"][0])
 	record.Set("event", "anwo_postback")
 	record.Set("os", "ios")
@@ -387,7 +374,7 @@ func serve_http() {
 	}).Infoln("Instance down.")
 	// REST route
 	r := mux.NewRouter()
-	r.HandleFunc("/anwo", EventHandler)
+	r.HandleFunc("/anwo", signer.Wrap(EventHandler))
 	r.HandleFunc("/ping", et.PingHandler)
 	// bring up the service
 	var ln net.Listener
@@ -547,6 +534,17 @@ func init() {
 	avro = et.NewAvroInst(log, conf.Avro)
 	// init kafka
 	kafka = et.NewKafkaInst(log, conf.Kafka)
+	timestamps = et.NewTimestampNormalizer(log, conf.Timestamp)
+	// the legacy md5 sign of anwo unless configured otherwise
+	signing, ok := conf.Signing["anwo"]
+	if !ok {
+		signing.Algorithm = et.SignMD5
+		signing.Params = []string{"adid", "adname", "appid", "device", "idfa", "point", "ts"}
+	}
+	if signing.Key == "" {
+		signing.Key = conf.Extension.Anwo.Key
+	}
+	signer = et.NewSigner(log, signing)
 	log.WithFields(logrus.Fields{
 		"module": "adwo",
 	}).Infoln("Initialization done.")
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	et "github.com/lixin9311/EventTracker/eventtracker"
+	"github.com/lixin9311/logrus"
+	"os"
+)
+
+var (
+	configFile  = flag.String("c", "config.toml", "config file")
+	sampleFile  = flag.String("i", "transform_samples.json", "sample events, one json object or an array of objects")
+	multiValue  *et.MultiValuePolicy
+	transformer *et.EventTransformer
+	validator   *et.EventValidator
+	log         = logrus.New()
+)
+
+func init() {
+	flag.Parse()
+	conf := et.ParseConfig(*configFile)
+	multiValue = et.NewMultiValuePolicy(log, conf.Multi_value, et.NewAvroInst(log, conf.Avro))
+	transformer = et.NewEventTransformer(log, conf.Events)
+	validator = et.NewEventValidator(log, conf.Events)
+}
+
+func main() {
+	file, err := os.Open(*sampleFile)
+	if err != nil {
+		log.Fatalln("Failed to open sample file:", err)
+	}
+	defer file.Close()
+	events, err := et.DecodeJSONEvents(file)
+	if err != nil {
+		log.Fatalln("Failed to decode sample file:", err)
+	}
+	failed := 0
+	for i, event := range events {
+		multiValue.Apply(event)
+		input, _ := json.Marshal(event)
+		transformer.Transform(event)
+		output, _ := json.Marshal(event)
+		fmt.Printf("#%d %s\n", i+1, event.EventType())
+		fmt.Printf("  input:  %s\n", input)
+		fmt.Printf("  output: %s\n", output)
+		if err := event.CheckRequired(); err != nil {
+			failed++
+			fmt.Printf("  error:  %s\n", err)
+		} else if err := validator.Validate(event); err != nil {
+			failed++
+			fmt.Printf("  error:  %s\n", err)
+		}
+	}
+	fmt.Printf("%d events, %d failed.\n", len(events), failed)
+	if failed != 0 {
+		os.Exit(1)
+	}
+}